@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 
 	"github.com/acristoffers/dbkp/pkg/dbkp"
@@ -21,6 +22,9 @@ var addCmd = &cobra.Command{
         Name = "file"
         Path = "/path/to/file"
 
+    - dbkp add --preset flatpak
+      Adds the built-in flatpak entry. See dbkp presets list.
+
     - dbkp add --command brew.leaves --backup "brew leaves" --restore "xargs brew install"
       Creates a command entry as
       [[Commands]]
@@ -48,12 +52,30 @@ var addCmd = &cobra.Command{
 			os.Exit(1)
 		}
 
+		excludeSyntax, err := cmd.Flags().GetString("exclude-syntax")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not parse options: %s\n", err)
+			os.Exit(1)
+		}
+
 		symlinks, err := cmd.Flags().GetStringSlice("symlinks")
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Could not parse options: %s\n", err)
 			os.Exit(1)
 		}
 
+		encrypt, err := cmd.Flags().GetBool("encrypt")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not parse options: %s\n", err)
+			os.Exit(1)
+		}
+
+		preset, err := cmd.Flags().GetString("preset")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not parse options: %s\n", err)
+			os.Exit(1)
+		}
+
 		command, err := cmd.Flags().GetString("command")
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Could not parse options: %s\n", err)
@@ -72,6 +94,36 @@ var addCmd = &cobra.Command{
 			os.Exit(1)
 		}
 
+		check, err := cmd.Flags().GetString("check")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not parse options: %s\n", err)
+			os.Exit(1)
+		}
+
+		shell, err := cmd.Flags().GetString("shell")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not parse options: %s\n", err)
+			os.Exit(1)
+		}
+
+		dir, err := cmd.Flags().GetString("dir")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not parse options: %s\n", err)
+			os.Exit(1)
+		}
+
+		env, err := cmd.Flags().GetStringToString("env")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not parse options: %s\n", err)
+			os.Exit(1)
+		}
+
+		timeout, err := cmd.Flags().GetDuration("timeout")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not parse options: %s\n", err)
+			os.Exit(1)
+		}
+
 		if len(only) > 0 && len(args) > 1 {
 			fmt.Fprintf(os.Stderr, "If --only is given, than only one path is allowed.\n")
 			os.Exit(1)
@@ -81,10 +133,16 @@ var addCmd = &cobra.Command{
 		} else if len(symlinks) > 0 && len(args) > 1 {
 			fmt.Fprintf(os.Stderr, "If --symlinks is given, than only one path is allowed.\n")
 			os.Exit(1)
+		} else if excludeSyntax != "" && excludeSyntax != dbkp.ExcludeSyntaxRegexp && excludeSyntax != dbkp.ExcludeSyntaxGitignore {
+			fmt.Fprintf(os.Stderr, "--exclude-syntax must be either %s or %s.\n", dbkp.ExcludeSyntaxRegexp, dbkp.ExcludeSyntaxGitignore)
+			os.Exit(1)
 		} else if len(exclude) > 0 && len(only) > 0 {
 			fmt.Fprintf(os.Stderr, "--exclude and --only are mutually exclusive.\n")
 			os.Exit(1)
-		} else if len(command) == 0 && len(args) == 0 {
+		} else if len(preset) != 0 && (len(command) != 0 || len(args) != 0) {
+			fmt.Fprintf(os.Stderr, "--preset cannot be combined with --command or paths.\n")
+			os.Exit(1)
+		} else if len(preset) == 0 && len(command) == 0 && len(args) == 0 {
 			fmt.Fprintf(os.Stderr, "The file path is required.\n")
 			os.Exit(1)
 		} else if len(command) != 0 && len(args) != 0 {
@@ -95,7 +153,7 @@ var addCmd = &cobra.Command{
 			os.Exit(1)
 		}
 
-		recipePath, err := filepath.Abs("./dbkp.toml")
+		recipePath, err := findRecipePath(cmd)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Could not get recipe path: %s\n", err)
 			os.Exit(1)
@@ -120,6 +178,24 @@ var addCmd = &cobra.Command{
 		for _, command := range recipe.Commands {
 			names = append(names, command.Name)
 		}
+		for _, set := range recipe.Packages {
+			names = append(names, set.Name)
+		}
+
+		if len(preset) > 0 {
+			entry, err := dbkp.FindPreset(preset)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "An error ocurred: %s\n", err)
+				os.Exit(1)
+			}
+
+			if slices.Contains(names, entry.Name) {
+				fmt.Fprintf(os.Stderr, "Skipping %s: Name already exists in the recipe.\n", entry.Name)
+				os.Exit(1)
+			}
+
+			recipe.AddPreset(entry)
+		}
 
 	path:
 		for _, pathString := range args {
@@ -151,8 +227,9 @@ var addCmd = &cobra.Command{
 			}
 
 			file := dbkp.File{
-				Name: fileName,
-				Path: path,
+				Name:    fileName,
+				Path:    path,
+				Encrypt: encrypt,
 			}
 
 			if len(only) > 0 {
@@ -160,6 +237,9 @@ var addCmd = &cobra.Command{
 			}
 			if len(exclude) > 0 {
 				file.Exclude = exclude
+				if excludeSyntax == dbkp.ExcludeSyntaxGitignore {
+					file.ExcludeSyntax = excludeSyntax
+				}
 			}
 			if len(symlinks) > 0 {
 				if len(symlinks)%2 != 0 {
@@ -181,14 +261,28 @@ var addCmd = &cobra.Command{
 		}
 
 		if len(command) > 0 {
-			recipe.Commands = append(recipe.Commands, dbkp.Command{
+			entry := dbkp.Command{
 				Name:    command,
 				Backup:  backup,
 				Restore: restore,
-			})
+				Check:   check,
+				Encrypt: encrypt,
+				Shell:   shell,
+				Dir:     dir,
+			}
+
+			if len(env) > 0 {
+				entry.Env = env
+			}
+
+			if timeout > 0 {
+				entry.Timeout = timeout.String()
+			}
+
+			recipe.Commands = append(recipe.Commands, entry)
 		}
 
-		if err := recipe.WriteRecipe(recipePath); err != nil {
+		if err := dbkp.SaveRecipe(recipePath, recipe); err != nil {
 			fmt.Fprintf(os.Stderr, "Cannot open file %s: %s.\n", recipePath, err)
 			os.Exit(1)
 		}
@@ -197,10 +291,19 @@ var addCmd = &cobra.Command{
 
 func init() {
 	RootCmd.AddCommand(addCmd)
-	addCmd.Flags().StringSliceP("only", "o", []string{}, "Adds files/folders to the Only entry. Example: --only file1,file2,file3")
+	addCmd.Flags().StringSliceP("only", "o", []string{}, "Adds relative paths or globs to the Only entry. Example: --only init.lua,'lua/plugins/*.lua'")
 	addCmd.Flags().StringSliceP("exclude", "e", []string{}, "Adds Go regexp patterns (matched against relative paths using `/`) to the Exclude entry. Example: --exclude 'cache$',tmp")
+	addCmd.Flags().String("exclude-syntax", "", "Syntax of the --exclude patterns, regexp (default) or gitignore. Example: --exclude-syntax gitignore --exclude node_modules/,'*.log'")
 	addCmd.Flags().StringSliceP("symlinks", "s", []string{}, "Adds symlinks. Example: --symlinks .,~/.neovim,init.vim,~/.vimrc")
+	addCmd.Flags().Bool("encrypt", false, "Stores this entry encrypted, even if the backup is not")
+	addCmd.Flags().StringP("preset", "p", "", "Adds a built-in entry from dbkp presets list: --preset flatpak")
+	addCmd.RegisterFlagCompletionFunc("preset", completePresets)
 	addCmd.Flags().StringP("command", "c", "", "Adds a command instead of a file. The name must be a valid file name: --command brew.leaves")
+	addCmd.Flags().String("check", "", "Prints the current state before restoring, so only missing lines are piped into the restore command: --check 'brew leaves'")
+	addCmd.Flags().String("shell", "", "The shell running the commands with -c, sh by default. Use none to run them without a shell: --shell bash")
+	addCmd.Flags().String("dir", "", "The working directory of the commands: --dir ~/projects")
+	addCmd.Flags().StringToString("env", map[string]string{}, "Environment variables for the commands: --env HOMEBREW_NO_AUTO_UPDATE=1")
+	addCmd.Flags().Duration("timeout", 0, "Kills the commands if they run for longer than this: --timeout 5m")
 	addCmd.Flags().StringP("backup", "b", "", "The backup command. Its output will be saved to Command Name: --backup 'brew leaves'")
 	addCmd.Flags().StringP("restore", "r", "", "The restore command. The Command Name file will be read and piped into this command's stdin: --backup 'xargs brew install'")
 }
@@ -2,14 +2,17 @@ package cmd
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"runtime"
 	"slices"
 	"strings"
 
 	"github.com/acristoffers/dbkp/pkg/dbkp"
-	"github.com/schollz/progressbar/v3"
 	"github.com/spf13/cobra"
 )
 
@@ -20,7 +23,7 @@ var backupCmd = &cobra.Command{
 	ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
 		suggestions := []string{}
 
-		recipePath, names, err := resolveRecipePathAndNames(args)
+		recipePath, names, err := resolveRecipePathAndNames(cmd, args)
 		if err != nil {
 			return suggestions, cobra.ShellCompDirectiveNoFileComp
 		}
@@ -42,16 +45,39 @@ var backupCmd = &cobra.Command{
 			}
 		}
 
+		for _, set := range recipe.Packages {
+			if strings.HasPrefix(set.Name, toComplete) && !slices.Contains(names, set.Name) {
+				suggestions = append(suggestions, set.Name)
+			}
+		}
+
 		return suggestions, cobra.ShellCompDirectiveNoFileComp
 	},
 	Run: func(cmd *cobra.Command, args []string) {
+		output, err := cmd.Flags().GetString("output")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not parse options: %s\n", err)
+			os.Exit(1)
+		}
+
+		if err := checkOutput(output); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not parse options: %s\n", err)
+			os.Exit(1)
+		}
+
+		jobs, err := cmd.Flags().GetInt("jobs")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not parse options: %s\n", err)
+			os.Exit(1)
+		}
+
 		encrypt, err := cmd.Flags().GetBool("encrypt")
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Could not parse options: %s\n", err)
 			os.Exit(1)
 		}
 
-		recipePath, names, err := resolveRecipePathAndNames(args)
+		recipePath, names, err := resolveRecipePathAndNames(cmd, args)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "An error ocurred: %s\n", err)
 			os.Exit(1)
@@ -65,60 +91,83 @@ var backupCmd = &cobra.Command{
 			os.Exit(1)
 		}
 
-		password := []byte{}
-		if encrypt || len(recipe.EncryptionSalt) > 0 && len(recipe.EncryptionSalt[0]) > 0 {
-			password1, err := dbkp.AskForPassword()
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "An error ocurred: %s\n", err)
-				os.Exit(1)
-			}
+		if encrypt && !recipe.Encrypted() {
+			recipe.EnableEncryption()
+		}
 
-			fmt.Println("Type again, for confirmation.")
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
 
-			password2, err := dbkp.AskForPassword()
+		var view *progressView
+		var events *eventWriter
+		if output == outputJSON {
+			events = newEventWriter("backup")
+		}
+
+		report, err := dbkp.Backup(ctx, dbkp.Options{
+			Path:       path,
+			RecipeFile: recipePath,
+			Recipe:     recipe,
+			Names:      names,
+			Password:   askForNewPassword,
+			Jobs:       jobs,
+			Progress: func(r dbkp.ProgressReport) {
+				if events != nil {
+					events.report(r)
+					return
+				}
+
+				if view == nil {
+					view = newProgressView("Backing up")
+				}
+				view.update(r)
+			},
+		})
+
+		if events != nil {
+			events.summary(err)
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "An error ocurred: %s\n", err)
-				os.Exit(1)
+				os.Exit(exitCode(err))
 			}
+			return
+		}
 
-			if !bytes.Equal(password1, password2) {
-				fmt.Fprintln(os.Stderr, "Passwords do not match")
-				os.Exit(1)
-			}
+		view.clear()
+		printSkipped(report.Skipped)
+		printFailures(report.Failures)
+		printSecrets(report.Secrets)
 
-			password = password1
-		} else {
-			password = nil
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "An error ocurred: %s\n", err)
+			os.Exit(exitCode(err))
 		}
+	},
+}
 
-		bar := progressbar.NewOptions(100,
-			progressbar.OptionSetWriter(os.Stdout),
-			progressbar.OptionThrottle(0),
-			progressbar.OptionShowCount(),
-			progressbar.OptionFullWidth(),
-			progressbar.OptionSetRenderBlankState(true))
+// Asks for a new password twice, for confirmation.
+func askForNewPassword() ([]byte, error) {
+	password1, err := dbkp.AskForPassword()
+	if err != nil {
+		return nil, err
+	}
 
-		channel := make(chan dbkp.ProgressReport)
+	fmt.Fprintln(os.Stderr, "Type again, for confirmation.")
 
-		go func() {
-			if err := dbkp.BackupSelected(path, recipe, password, channel, names); err != nil {
-				bar.Clear()
-				fmt.Fprintf(os.Stderr, "An error ocurred: %s\n", err)
-				os.Exit(1)
-			}
-		}()
+	password2, err := dbkp.AskForPassword()
+	if err != nil {
+		return nil, err
+	}
 
-		for c := range channel {
-			bar.ChangeMax64(int64(c.Total))
-			bar.Describe(fmt.Sprintf("Backing up %s", c.Name))
-			bar.Set64(int64(c.Count))
-		}
+	if !bytes.Equal(password1, password2) {
+		return nil, errors.New("passwords do not match")
+	}
 
-		bar.Clear()
-	},
+	return password1, nil
 }
 
 func init() {
 	RootCmd.AddCommand(backupCmd)
+	backupCmd.Flags().StringP("output", "O", outputText, "Output format: text, or json for newline-delimited JSON events")
+	backupCmd.Flags().IntP("jobs", "j", runtime.NumCPU(), "Number of entries processed at the same time")
 	backupCmd.Flags().BoolP("encrypt", "e", false, "Enables encryption for this backup, if it is not enabled already")
 }
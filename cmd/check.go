@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/acristoffers/dbkp/pkg/dbkp"
+	"github.com/spf13/cobra"
+)
+
+var checkCmd = &cobra.Command{
+	Use:   "check [dbkp.toml]",
+	Args:  cobra.MaximumNArgs(1),
+	Short: "Checks the recipe for problems without running anything",
+	Long: `Checks dbkp.toml for problems that would otherwise only show up during a
+    backup: unknown keys, invalid, duplicated or case-colliding names, patterns
+    that do not compile, Only and Exclude both set, incomplete symlink pairs,
+    missing paths, paths nested inside each other and paths containing the
+    backup folder.
+
+    Files included by the recipe are checked too, and each problem is printed
+    with its file, line and column. Exits with an error if any is found.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		recipePath, _, err := resolveRecipePathAndNames(cmd, args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not get recipe path: %s\n", err)
+			os.Exit(1)
+		}
+
+		problems, err := dbkp.CheckRecipe(recipePath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "An error ocurred: %s\n", err)
+			os.Exit(1)
+		}
+
+		for _, problem := range problems {
+			name := relativeToWd(problem.File)
+			location := name
+			if problem.Line > 0 {
+				location = fmt.Sprintf("%s:%d:%d", name, problem.Line, problem.Column)
+			}
+			if problem.Entry != "" {
+				location += ": " + problem.Entry
+			}
+			fmt.Printf("%s: %s\n", location, problem.Err)
+		}
+
+		if len(problems) > 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(checkCmd)
+}
+
+// Returns path relative to the working directory if it is inside it, to print
+// it shorter.
+func relativeToWd(path string) string {
+	if wd, err := os.Getwd(); err == nil {
+		if rel, err := filepath.Rel(wd, path); err == nil && !strings.HasPrefix(rel, "..") {
+			return rel
+		}
+	}
+	return path
+}
@@ -0,0 +1,352 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/acristoffers/dbkp/pkg/dbkp"
+	"github.com/spf13/cobra"
+)
+
+var editCmd = &cobra.Command{
+	Use:   "edit NAME",
+	Args:  cobra.ExactArgs(1),
+	Short: "Changes an entry of the backup recipe",
+	Long: `Changes the entry NAME of dbkp.toml.
+
+    - dbkp edit nvim --add-exclude 'cache$' --remove-only init.vim
+      Adds and removes patterns of a file entry.
+
+    - dbkp edit brew.leaves --backup 'brew leaves --installed-on-request'
+      Changes the backup command of a command entry.
+
+    - dbkp edit nvim --editor
+      Opens only this entry in $EDITOR.
+
+    The changed entry is validated (patterns must compile and the path must
+    exist) before dbkp.toml is written. If the entry edited in $EDITOR is not
+    valid, you are asked to edit it again, and dbkp.toml is left unchanged if
+    you refuse.
+    `,
+	ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		suggestions := []string{}
+		if len(args) > 0 {
+			return suggestions, cobra.ShellCompDirectiveNoFileComp
+		}
+
+		path, err := findRecipePath(cmd)
+		if err != nil {
+			return suggestions, cobra.ShellCompDirectiveNoFileComp
+		}
+
+		recipe, err := dbkp.LoadRecipe(path)
+		if err != nil {
+			return suggestions, cobra.ShellCompDirectiveNoFileComp
+		}
+
+		for _, file := range recipe.Files {
+			if strings.HasPrefix(file.Name, toComplete) {
+				suggestions = append(suggestions, file.Name)
+			}
+		}
+
+		for _, command := range recipe.Commands {
+			if strings.HasPrefix(command.Name, toComplete) {
+				suggestions = append(suggestions, command.Name)
+			}
+		}
+
+		for _, set := range recipe.Packages {
+			if strings.HasPrefix(set.Name, toComplete) {
+				suggestions = append(suggestions, set.Name)
+			}
+		}
+
+		return suggestions, cobra.ShellCompDirectiveNoFileComp
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		name := args[0]
+
+		useEditor, err := cmd.Flags().GetBool("editor")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not parse options: %s\n", err)
+			os.Exit(1)
+		}
+
+		fileFlags := []string{"path", "add-only", "remove-only", "add-exclude", "remove-exclude", "add-symlinks", "remove-symlinks"}
+		commandFlags := []string{"backup", "restore", "check"}
+
+		changed := false
+		for _, flag := range append(fileFlags, commandFlags...) {
+			changed = changed || cmd.Flags().Changed(flag)
+		}
+
+		if useEditor && changed {
+			fmt.Fprintf(os.Stderr, "--editor cannot be combined with other options.\n")
+			os.Exit(1)
+		} else if !useEditor && !changed {
+			fmt.Fprintf(os.Stderr, "Nothing to change, pass an option or --editor.\n")
+			os.Exit(1)
+		}
+
+		recipePath, err := findRecipePath(cmd)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not get recipe path: %s\n", err)
+			os.Exit(1)
+		}
+
+		recipe, err := dbkp.LoadRecipe(recipePath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot open file %s: %s\n", recipePath, err)
+			os.Exit(1)
+		}
+
+		if useEditor {
+			if err := editInEditor(&recipe, name); err != nil {
+				fmt.Fprintf(os.Stderr, "An error ocurred: %s\n", err)
+				os.Exit(exitCode(err))
+			}
+		} else {
+			fileIndex := slices.IndexFunc(recipe.Files, func(file dbkp.File) bool { return file.Name == name })
+			commandIndex := slices.IndexFunc(recipe.Commands, func(command dbkp.Command) bool { return command.Name == name })
+
+			var err error
+			switch {
+			case fileIndex >= 0:
+				if flag := firstChanged(cmd, commandFlags); flag != "" {
+					fmt.Fprintf(os.Stderr, "--%s only applies to commands, %s is a file.\n", flag, name)
+					os.Exit(1)
+				}
+				err = editFile(cmd, &recipe.Files[fileIndex])
+			case commandIndex >= 0:
+				if flag := firstChanged(cmd, fileFlags); flag != "" {
+					fmt.Fprintf(os.Stderr, "--%s only applies to files, %s is a command.\n", flag, name)
+					os.Exit(1)
+				}
+				err = editCommand(cmd, &recipe.Commands[commandIndex])
+			case slices.ContainsFunc(recipe.Packages, func(set dbkp.PackageSet) bool { return set.Name == name }):
+				fmt.Fprintf(os.Stderr, "%s is a package set, which can only be changed with --editor.\n", name)
+				os.Exit(1)
+			default:
+				err = fmt.Errorf("%w: %s", dbkp.ErrUnknownEntry, name)
+			}
+
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "An error ocurred: %s\n", err)
+				os.Exit(exitCode(err))
+			}
+		}
+
+		if err := dbkp.SaveRecipe(recipePath, recipe); err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot open file %s: %s\n", recipePath, err)
+			os.Exit(1)
+		}
+	},
+}
+
+// Returns the first of flags that was given, or an empty string.
+func firstChanged(cmd *cobra.Command, flags []string) string {
+	for _, flag := range flags {
+		if cmd.Flags().Changed(flag) {
+			return flag
+		}
+	}
+	return ""
+}
+
+// Applies the file options of cmd to file and validates the result.
+func editFile(cmd *cobra.Command, file *dbkp.File) error {
+	if cmd.Flags().Changed("path") {
+		pathString, err := cmd.Flags().GetString("path")
+		if err != nil {
+			return err
+		}
+
+		path, err := filepath.Abs(pathString)
+		if err != nil {
+			return err
+		}
+
+		homePath, err := os.UserHomeDir()
+		if err != nil {
+			return err
+		}
+
+		if strings.HasPrefix(path, homePath) {
+			path = strings.Replace(path, homePath, "~", 1)
+		}
+
+		file.Path = path
+	}
+
+	addOnly, err := cmd.Flags().GetStringSlice("add-only")
+	if err != nil {
+		return err
+	}
+
+	removeOnly, err := cmd.Flags().GetStringSlice("remove-only")
+	if err != nil {
+		return err
+	}
+
+	addExclude, err := cmd.Flags().GetStringSlice("add-exclude")
+	if err != nil {
+		return err
+	}
+
+	removeExclude, err := cmd.Flags().GetStringSlice("remove-exclude")
+	if err != nil {
+		return err
+	}
+
+	addSymlinks, err := symlinkPairs(cmd, "add-symlinks")
+	if err != nil {
+		return err
+	}
+
+	removeSymlinks, err := symlinkPairs(cmd, "remove-symlinks")
+	if err != nil {
+		return err
+	}
+
+	file.Only = editList(file.Only, addOnly, removeOnly)
+	file.Exclude = editList(file.Exclude, addExclude, removeExclude)
+	file.Symlinks = editList(file.Symlinks, addSymlinks, removeSymlinks)
+
+	return file.Validate()
+}
+
+// Applies the command options of cmd to command and validates the result.
+func editCommand(cmd *cobra.Command, command *dbkp.Command) error {
+	for flag, script := range map[string]*string{"backup": &command.Backup, "restore": &command.Restore, "check": &command.Check} {
+		if !cmd.Flags().Changed(flag) {
+			continue
+		}
+
+		value, err := cmd.Flags().GetString(flag)
+		if err != nil {
+			return err
+		}
+		*script = value
+	}
+
+	return command.Validate()
+}
+
+// Returns list without the values in remove and with the values in add that
+// it does not contain yet. Returns nil instead of an empty list, so that the
+// key is left out of dbkp.toml.
+func editList[T comparable](list []T, add []T, remove []T) []T {
+	edited := []T{}
+	for _, value := range list {
+		if !slices.Contains(remove, value) {
+			edited = append(edited, value)
+		}
+	}
+
+	for _, value := range add {
+		if !slices.Contains(edited, value) {
+			edited = append(edited, value)
+		}
+	}
+
+	if len(edited) == 0 {
+		return nil
+	}
+	return edited
+}
+
+// Groups the values of the flag into symlink pairs.
+func symlinkPairs(cmd *cobra.Command, flag string) ([][2]string, error) {
+	values, err := cmd.Flags().GetStringSlice(flag)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(values)%2 != 0 {
+		return nil, fmt.Errorf("--%s requires an even number of arguments", flag)
+	}
+
+	pairs := [][2]string{}
+	for i := 0; i < len(values); i += 2 {
+		pairs = append(pairs, [2]string{values[i], values[i+1]})
+	}
+
+	return pairs, nil
+}
+
+// Opens the entry name of recipe in $VISUAL or $EDITOR (vi if neither is set)
+// and replaces it with the result, asking to edit again while it is not valid.
+func editInEditor(recipe *dbkp.Recipe, name string) error {
+	data, err := recipe.EncodeEntry(name)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp("", "dbkp-"+name+"-*.toml")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	editor := strings.Fields(os.Getenv("VISUAL"))
+	if len(editor) == 0 {
+		editor = strings.Fields(os.Getenv("EDITOR"))
+	}
+	if len(editor) == 0 {
+		editor = []string{"vi"}
+	}
+
+	for {
+		editorCmd := exec.Command(editor[0], append(editor[1:], file.Name())...)
+		editorCmd.Stdin = os.Stdin
+		editorCmd.Stdout = os.Stdout
+		editorCmd.Stderr = os.Stderr
+		if err := editorCmd.Run(); err != nil {
+			return fmt.Errorf("editor failed: %w", err)
+		}
+
+		data, err := os.ReadFile(file.Name())
+		if err != nil {
+			return err
+		}
+
+		err = recipe.DecodeEntry(name, data)
+		if err == nil {
+			return nil
+		}
+
+		fmt.Fprintf(os.Stderr, "The entry is not valid: %s\n", err)
+		if !confirm("Edit it again?") {
+			return fmt.Errorf("%s was not changed", name)
+		}
+	}
+}
+
+func init() {
+	RootCmd.AddCommand(editCmd)
+	editCmd.Flags().Bool("editor", false, "Opens only this entry in $EDITOR and validates it on save")
+	editCmd.Flags().String("path", "", "Changes the Path of a file entry: --path ~/.config/nvim")
+	editCmd.Flags().StringSlice("add-only", []string{}, "Adds relative paths or globs to Only: --add-only 'lua/*.lua'")
+	editCmd.Flags().StringSlice("remove-only", []string{}, "Removes paths or globs from Only: --remove-only init.vim")
+	editCmd.Flags().StringSlice("add-exclude", []string{}, "Adds patterns to Exclude: --add-exclude 'cache$'")
+	editCmd.Flags().StringSlice("remove-exclude", []string{}, "Removes patterns from Exclude: --remove-exclude tmp")
+	editCmd.Flags().StringSlice("add-symlinks", []string{}, "Adds symlinks, as pairs: --add-symlinks init.vim,~/.vimrc")
+	editCmd.Flags().StringSlice("remove-symlinks", []string{}, "Removes symlinks, as pairs: --remove-symlinks init.vim,~/.vimrc")
+	editCmd.Flags().String("backup", "", "Changes the backup command of a command entry: --backup 'brew leaves'")
+	editCmd.Flags().String("restore", "", "Changes the restore command of a command entry: --restore 'xargs brew install'")
+	editCmd.Flags().String("check", "", "Changes the check command of a command entry: --check 'brew leaves'")
+}
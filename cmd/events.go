@@ -0,0 +1,168 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/acristoffers/dbkp/pkg/dbkp"
+)
+
+// Values accepted by --output.
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+// Version of the schema of the JSON events. Fields may be added without
+// changing it, but not renamed or removed.
+const eventSchema = 1
+
+// A line of the newline-delimited JSON output of backup and restore.
+type event struct {
+	Event      string   `json:"event"`                 // start, phase, entry_started, file_copied, file_skipped, command_finished, warning, message, entry_finished, summary or plan.
+	Schema     int      `json:"schema,omitempty"`      // The eventSchema, in start events.
+	Command    string   `json:"command,omitempty"`     // backup or restore, in start events.
+	Entry      string   `json:"entry,omitempty"`       // The Name of the entry.
+	Phase      string   `json:"phase,omitempty"`       // What is being done, see dbkp.ProgressReport.Phase.
+	Count      uint64   `json:"count"`                 // Entries finished so far.
+	Total      uint64   `json:"total"`                 // Entries to be processed.
+	Path       string   `json:"path,omitempty"`        // The file, relative to the entry's Path, in file_* and secret warning events.
+	Reason     string   `json:"reason,omitempty"`      // Why the file was skipped.
+	BytesDone  uint64   `json:"bytes_done"`            // Bytes copied so far.
+	BytesTotal uint64   `json:"bytes_total"`           // Bytes to be copied, or 0 if unknown.
+	Script     string   `json:"script,omitempty"`      // The script that ran: backup, restore or check.
+	ExitCode   *int     `json:"exit_code,omitempty"`   // The exit code of the script, -1 if it was killed, or of dbkp, in failed summary events.
+	DurationMS *int64   `json:"duration_ms,omitempty"` // How long the script, entry or run took.
+	Kind       string   `json:"kind,omitempty"`        // The kind of warning: secret or command_failed.
+	Message    string   `json:"message,omitempty"`     // A human readable description.
+	OK         *bool    `json:"ok,omitempty"`          // Whether the run succeeded, in summary events.
+	Error      string   `json:"error,omitempty"`       // Why the run or entry failed, in summary and entry_finished events.
+	Skipped    *int     `json:"skipped,omitempty"`     // Files skipped, in summary events.
+	Warnings   *int     `json:"warnings,omitempty"`    // Warnings emitted, in summary events.
+	Package    string   `json:"package,omitempty"`     // The package that failed, in command_failed warnings of Packages entries.
+	Line       int      `json:"line,omitempty"`        // The line of the secret, in secret warnings.
+	Install    []string `json:"install,omitempty"`     // Packages to be installed, in plan events.
+	Remove     []string `json:"remove,omitempty"`      // Packages to be removed, in plan events.
+}
+
+// Writes the events of a backup or restore to stdout.
+type eventWriter struct {
+	encoder  *json.Encoder
+	start    time.Time
+	last     dbkp.ProgressReport // The last report with counts, for the summary.
+	skipped  int
+	warnings int
+}
+
+func newEventWriter(command string) *eventWriter {
+	writer := &eventWriter{encoder: json.NewEncoder(os.Stdout), start: time.Now()}
+	writer.write(event{Event: "start", Schema: eventSchema, Command: command})
+	return writer
+}
+
+func (writer *eventWriter) write(e event) {
+	writer.encoder.Encode(e)
+}
+
+// Writes the events described by report.
+func (writer *eventWriter) report(report dbkp.ProgressReport) {
+	if report.Phase != "" || report.Finished {
+		writer.last = report
+	}
+	base := event{Entry: report.Name, Count: report.Count, Total: report.Total, BytesDone: writer.last.BytesDone, BytesTotal: writer.last.BytesTotal}
+
+	switch {
+	case report.Skipped != nil:
+		writer.skipped++
+		base.Event = "file_skipped"
+		base.Path = report.Skipped.Path
+		base.Reason = report.Skipped.Reason
+	case report.Secret != nil:
+		writer.warnings++
+		base.Event = "warning"
+		base.Kind = "secret"
+		base.Path = report.Secret.Path
+		base.Line = report.Secret.Line
+		base.Message = fmt.Sprintf("%s %s", report.Secret.Rule, report.Secret.Match)
+	case report.Failure != nil:
+		writer.warnings++
+		base.Event = "warning"
+		base.Kind = "command_failed"
+		base.Package = report.Failure.Package
+		base.ExitCode = &report.Failure.ExitCode
+		base.Message = report.Failure.Error
+	case report.Command != nil:
+		base.Event = "command_finished"
+		base.Script = report.Command.Script
+		base.ExitCode = &report.Command.ExitCode
+		base.DurationMS = milliseconds(report.Command.Duration)
+	case report.Message != "":
+		base.Event = "message"
+		base.Message = report.Message
+	case report.Finished:
+		base.Event = "entry_finished"
+		base.DurationMS = milliseconds(report.Duration)
+		if report.Error != nil {
+			base.Error = report.Error.Error()
+		}
+	case report.Phase == dbkp.PhaseCopying && report.File != "":
+		base.Event = "file_copied"
+		base.Phase = report.Phase
+		base.Path = report.File
+	case report.Phase == dbkp.PhaseCopying || report.Phase == dbkp.PhaseRunning:
+		base.Event = "entry_started"
+		base.Phase = report.Phase
+	default:
+		base.Event = "phase"
+		base.Phase = report.Phase
+	}
+
+	writer.write(base)
+}
+
+// Writes the final summary event, with the error that ended the run, if any.
+func (writer *eventWriter) summary(err error) {
+	ok := err == nil
+	e := event{
+		Event:      "summary",
+		Count:      writer.last.Count,
+		Total:      writer.last.Total,
+		BytesDone:  writer.last.BytesDone,
+		BytesTotal: writer.last.BytesTotal,
+		OK:         &ok,
+		Skipped:    &writer.skipped,
+		Warnings:   &writer.warnings,
+		DurationMS: milliseconds(time.Since(writer.start)),
+	}
+
+	if err != nil {
+		code := exitCode(err)
+		e.Error = err.Error()
+		e.ExitCode = &code
+	}
+
+	writer.write(e)
+}
+
+func milliseconds(duration time.Duration) *int64 {
+	ms := duration.Milliseconds()
+	return &ms
+}
+
+// Validates the value of --output.
+func checkOutput(output string) error {
+	if output != outputText && output != outputJSON {
+		return fmt.Errorf("--output must be either %s or %s", outputText, outputJSON)
+	}
+	return nil
+}
+
+// Writes a plan event for each PackageSet of a dry-run restore.
+func writePackagePlans(plans []dbkp.PackagePlan) {
+	encoder := json.NewEncoder(os.Stdout)
+	for _, plan := range plans {
+		encoder.Encode(event{Event: "plan", Entry: plan.Entry, Install: plan.Install, Remove: plan.Remove})
+	}
+}
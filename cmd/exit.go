@@ -0,0 +1,41 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+
+	"github.com/acristoffers/dbkp/pkg/dbkp"
+)
+
+// Exit codes of backup, restore and scan when they fail.
+const (
+	exitError         = 1   // Any error not listed below.
+	exitUnknownEntry  = 2   // A name given as argument is not in the recipe.
+	exitWrongPassword = 3   // The password does not decrypt the backup.
+	exitCorrupt       = 4   // The backup cannot be read.
+	exitCommandFailed = 5   // A script of a Command or PackageSet failed.
+	exitUnavailable   = 6   // A Destination is not there, like an unmounted drive.
+	exitInterrupted   = 130 // The run was interrupted with Ctrl-C.
+)
+
+// Returns the exit code for err.
+func exitCode(err error) int {
+	var commandErr *dbkp.CommandError
+
+	switch {
+	case errors.Is(err, context.Canceled):
+		return exitInterrupted
+	case errors.Is(err, dbkp.ErrUnknownEntry):
+		return exitUnknownEntry
+	case errors.Is(err, dbkp.ErrWrongPassword):
+		return exitWrongPassword
+	case errors.Is(err, dbkp.ErrCorruptArchive):
+		return exitCorrupt
+	case errors.As(err, &commandErr):
+		return exitCommandFailed
+	case errors.Is(err, dbkp.ErrDestinationUnavailable):
+		return exitUnavailable
+	default:
+		return exitError
+	}
+}
@@ -0,0 +1,78 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/acristoffers/dbkp/pkg/dbkp"
+	"github.com/spf13/cobra"
+)
+
+var gcCmd = &cobra.Command{
+	Use:   "gc",
+	Short: "Deletes backup data that no entry of the recipe uses",
+	Long: `Finds the data stored in the backup for entries that are no longer in
+    dbkp.toml, lists it and deletes it after confirmation.
+
+    Encrypted backups ask for the password and are rewritten.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		yes, err := cmd.Flags().GetBool("yes")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not parse options: %s\n", err)
+			os.Exit(1)
+		}
+
+		recipePath, err := findRecipePath(cmd)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not get recipe path: %s\n", err)
+			os.Exit(1)
+		}
+
+		recipe, err := dbkp.LoadRecipe(recipePath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot open file %s: %s\n", recipePath, err)
+			os.Exit(1)
+		}
+
+		// Asked once, for both reading and rewriting the backup.
+		var password []byte
+		askOnce := func() ([]byte, error) {
+			if password != nil {
+				return password, nil
+			}
+			password, err = dbkp.AskForPassword()
+			return password, err
+		}
+
+		orphans, err := dbkp.Orphans(recipePath, recipe, askOnce)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "An error ocurred: %s\n", err)
+			os.Exit(exitCode(err))
+		}
+
+		if len(orphans) == 0 {
+			fmt.Println("Nothing to delete.")
+			return
+		}
+
+		fmt.Println("Stored data with no entry in the recipe:")
+		for _, name := range orphans {
+			fmt.Printf("  %s\n", name)
+		}
+
+		if !yes && !confirm(fmt.Sprintf("Delete %d orphaned entries?", len(orphans))) {
+			return
+		}
+
+		if err := dbkp.Purge(recipePath, recipe, orphans, askOnce); err != nil {
+			fmt.Fprintf(os.Stderr, "An error ocurred: %s\n", err)
+			os.Exit(exitCode(err))
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(gcCmd)
+	gcCmd.Flags().BoolP("yes", "y", false, "Deletes without asking for confirmation")
+}
@@ -1,8 +1,6 @@
 package cmd
 
 import (
-	"crypto/rand"
-	"encoding/hex"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -14,9 +12,13 @@ import (
 var initCmd = &cobra.Command{
 	Use:   "init",
 	Short: "Creates a dbkp project in the current directory",
-	Long:  `Creates an empty recipe in the current folder.`,
+	Long: `Creates an empty recipe in the current folder, or at the path given with
+    --recipe or DBKP_RECIPE.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		path, err := filepath.Abs("./dbkp.toml")
+		path, err := givenRecipePath(cmd)
+		if err == nil && path == "" {
+			path, err = filepath.Abs(recipeFileName)
+		}
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Could not get recipe path: %s\n", err)
 			os.Exit(1)
@@ -47,11 +49,7 @@ var initCmd = &cobra.Command{
 		} else {
 			recipe := dbkp.Recipe{}
 			if encrypt {
-				iv := make([]byte, 12)
-				salt := make([]byte, 32)
-				rand.Read(iv)
-				rand.Read(salt)
-				recipe.EncryptionSalt = [2]string{hex.EncodeToString(salt), hex.EncodeToString(iv)}
+				recipe.EnableEncryption()
 			}
 			if err := recipe.WriteRecipe(path); err != nil {
 				fmt.Fprintf(os.Stderr, "Cannot open file %s: %s\n", path, err)
@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -25,32 +26,60 @@ var listCmd = &cobra.Command{
 			os.Exit(1)
 		}
 
-		var recipePath string
+		output, err := cmd.Flags().GetString("output")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not parse options: %s\n", err)
+			os.Exit(1)
+		}
 
-		if len(args) == 1 {
-			recipePath, err = filepath.Abs(args[0])
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "An error ocurred: %s\n", err)
-				os.Exit(1)
-			}
-		} else if len(args) == 0 {
-			recipePath, err = filepath.Abs(filepath.Join(".", "dbkp.toml"))
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "An error ocurred: %s\n", err)
-				os.Exit(1)
-			}
-		} else {
+		if err := checkOutput(output); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not parse options: %s\n", err)
+			os.Exit(1)
+		}
+
+		resolved, err := cmd.Flags().GetBool("resolved")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not parse options: %s\n", err)
+			os.Exit(1)
+		}
+
+		recipePath, rest, err := resolveRecipePathAndNames(cmd, args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not get recipe path: %s\n", err)
+			os.Exit(1)
+		}
+
+		if len(rest) > 0 {
 			fmt.Fprintln(os.Stderr, "Usage: dbkp list [/path/to/dbkp.toml]")
 			os.Exit(1)
 		}
 
-		recipe, err := dbkp.LoadRecipe(recipePath)
+		recipe, sources, err := dbkp.ResolveRecipe(recipePath)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "An error ocurred: %s\n", err)
 			os.Exit(1)
 		}
 
-		if len(recipe.EncryptionSalt) > 0 && len(recipe.EncryptionSalt[0]) > 0 {
+		// Where each entry comes from, relative to the recipe, if asked.
+		var from map[string][]string
+		if resolved {
+			from = map[string][]string{}
+			for name, paths := range sources {
+				for _, path := range paths {
+					if rel, err := filepath.Rel(filepath.Dir(recipePath), path); err == nil {
+						path = rel
+					}
+					from[name] = append(from[name], path)
+				}
+			}
+		}
+
+		if output == outputJSON {
+			writeRecipeEntries(recipe, from)
+			return
+		}
+
+		if recipe.Encrypted() {
 			fmt.Println("Encryption enabled")
 		} else {
 			fmt.Println("Encryption disabled")
@@ -59,11 +88,15 @@ var listCmd = &cobra.Command{
 
 		if machine {
 			for _, file := range recipe.Files {
-				fmt.Println(formatFileMachine(file))
+				fmt.Println(withSources(formatFileMachine(file), from, file.Name))
 			}
 
 			for _, command := range recipe.Commands {
-				fmt.Println(formatCommandMachine(command))
+				fmt.Println(withSources(formatCommandMachine(command), from, command.Name))
+			}
+
+			for _, set := range recipe.Packages {
+				fmt.Println(withSources(formatPackagesMachine(set), from, set.Name))
 			}
 			return
 		}
@@ -74,29 +107,83 @@ var listCmd = &cobra.Command{
 		}
 		lipgloss.SetDefaultRenderer(renderer)
 
-		filesTable := renderFilesTable(renderer, recipe.Files)
+		filesTable := renderFilesTable(renderer, recipe.Files, from)
 		if filesTable != "" {
 			fmt.Println(filesTable)
 		}
 
-		commandsTable := renderCommandsTable(renderer, recipe.Commands)
+		commandsTable := renderCommandsTable(renderer, recipe.Commands, from)
 		if commandsTable != "" {
 			if filesTable != "" {
 				fmt.Println()
 			}
 			fmt.Println(commandsTable)
 		}
+
+		packagesTable := renderPackagesTable(renderer, recipe.Packages, from)
+		if packagesTable != "" {
+			if filesTable != "" || commandsTable != "" {
+				fmt.Println()
+			}
+			fmt.Println(packagesTable)
+		}
 	},
 }
 
 func init() {
 	RootCmd.AddCommand(listCmd)
 	listCmd.Flags().BoolP("machine", "m", false, "Machine-readable output using tab separators")
+	listCmd.Flags().StringP("output", "O", outputText, "Output format: text, or json for one JSON object per line")
+	listCmd.Flags().Bool("resolved", false, "Shows the recipe files each entry comes from, when the recipe has includes")
+}
+
+// A line of the JSON output of list. The first line has kind recipe and
+// tells whether the backup is encrypted; the following ones hold an entry
+// each, with the fields it has in dbkp.toml.
+type listEntry struct {
+	Kind      string           `json:"kind"` // recipe, file, command or packages.
+	Schema    int              `json:"schema,omitempty"`
+	Encrypted *bool            `json:"encrypted,omitempty"`
+	File      *dbkp.File       `json:"file,omitempty"`
+	Command   *dbkp.Command    `json:"command,omitempty"`
+	Packages  *dbkp.PackageSet `json:"packages,omitempty"`
+	Sources   []string         `json:"sources,omitempty"` // The recipe files defining the entry, with --resolved.
+}
+
+func writeRecipeEntries(recipe dbkp.Recipe, from map[string][]string) {
+	encoder := json.NewEncoder(os.Stdout)
+
+	encrypted := recipe.Encrypted()
+	encoder.Encode(listEntry{Kind: "recipe", Schema: eventSchema, Encrypted: &encrypted})
+
+	for _, file := range recipe.Files {
+		encoder.Encode(listEntry{Kind: "file", File: &file, Sources: from[file.Name]})
+	}
+
+	for _, command := range recipe.Commands {
+		encoder.Encode(listEntry{Kind: "command", Command: &command, Sources: from[command.Name]})
+	}
+
+	for _, set := range recipe.Packages {
+		encoder.Encode(listEntry{Kind: "packages", Packages: &set, Sources: from[set.Name]})
+	}
+}
+
+// Appends the files the entry name comes from to line, if from is set.
+func withSources(line string, from map[string][]string, name string) string {
+	if from == nil {
+		return line
+	}
+	return line + "\tFrom: " + strings.Join(from[name], " ")
 }
 
 func formatFileMachine(file dbkp.File) string {
 	fields := []string{file.Name, file.Path}
 
+	if file.Encrypt {
+		fields = append(fields, "Encrypted")
+	}
+
 	if len(file.Only) > 0 {
 		fields = append(fields, fmt.Sprintf("Only: %s", strings.Join(file.Only, " ")))
 	} else if len(file.Exclude) > 0 {
@@ -115,10 +202,26 @@ func formatFileMachine(file dbkp.File) string {
 }
 
 func formatCommandMachine(command dbkp.Command) string {
-	return strings.Join([]string{command.Name, command.Backup, command.Restore}, "\t")
+	fields := []string{command.Name, command.Backup, command.Restore}
+
+	if command.Encrypt {
+		fields = append(fields, "Encrypted")
+	}
+
+	return strings.Join(fields, "\t")
+}
+
+func formatPackagesMachine(set dbkp.PackageSet) string {
+	fields := []string{set.Name, set.List, set.Install}
+
+	if set.Prune {
+		fields = append(fields, fmt.Sprintf("Prune: %s", set.Remove))
+	}
+
+	return strings.Join(fields, "\t")
 }
 
-func renderFilesTable(renderer *lipgloss.Renderer, files []dbkp.File) string {
+func renderFilesTable(renderer *lipgloss.Renderer, files []dbkp.File, from map[string][]string) string {
 	if len(files) == 0 {
 		return ""
 	}
@@ -145,13 +248,14 @@ func renderFilesTable(renderer *lipgloss.Renderer, files []dbkp.File) string {
 			symlinks = strings.Join(entries, ", ")
 		}
 
-		rows = append(rows, []string{file.Name, file.Path, only, exclude, symlinks})
+		rows = append(rows, []string{file.Name, file.Path, only, exclude, symlinks, formatEncrypted(file.Encrypt)})
 	}
 
-	return renderTable(renderer, "Files", []string{"Name", "Path", "Only", "Exclude", "Symlinks"}, rows)
+	headers, rows := withSourcesColumn([]string{"Name", "Path", "Only", "Exclude", "Symlinks", "Encrypted"}, rows, from)
+	return renderTable(renderer, "Files", headers, rows)
 }
 
-func renderCommandsTable(renderer *lipgloss.Renderer, commands []dbkp.Command) string {
+func renderCommandsTable(renderer *lipgloss.Renderer, commands []dbkp.Command, from map[string][]string) string {
 	if len(commands) == 0 {
 		return ""
 	}
@@ -159,10 +263,52 @@ func renderCommandsTable(renderer *lipgloss.Renderer, commands []dbkp.Command) s
 	rows := make([][]string, 0, len(commands))
 
 	for _, command := range commands {
-		rows = append(rows, []string{command.Name, command.Backup, command.Restore})
+		rows = append(rows, []string{command.Name, command.Backup, command.Restore, formatEncrypted(command.Encrypt)})
 	}
 
-	return renderTable(renderer, "Commands", []string{"Name", "Backup", "Restore"}, rows)
+	headers, rows := withSourcesColumn([]string{"Name", "Backup", "Restore", "Encrypted"}, rows, from)
+	return renderTable(renderer, "Commands", headers, rows)
+}
+
+func renderPackagesTable(renderer *lipgloss.Renderer, sets []dbkp.PackageSet, from map[string][]string) string {
+	if len(sets) == 0 {
+		return ""
+	}
+
+	rows := make([][]string, 0, len(sets))
+
+	for _, set := range sets {
+		prune := ""
+		if set.Prune {
+			prune = "yes"
+		}
+
+		rows = append(rows, []string{set.Name, set.List, set.Install, set.Remove, prune})
+	}
+
+	headers, rows := withSourcesColumn([]string{"Name", "List", "Install", "Remove", "Prune"}, rows, from)
+	return renderTable(renderer, "Packages", headers, rows)
+}
+
+// Adds a From column with the files each row's entry comes from, if from is
+// set. The first column of the rows must be the Name.
+func withSourcesColumn(headers []string, rows [][]string, from map[string][]string) ([]string, [][]string) {
+	if from == nil {
+		return headers, rows
+	}
+
+	for i, row := range rows {
+		rows[i] = append(row, strings.Join(from[row[0]], ", "))
+	}
+
+	return append(headers, "From"), rows
+}
+
+func formatEncrypted(encrypted bool) string {
+	if encrypted {
+		return "yes"
+	}
+	return ""
 }
 
 func renderTable(renderer *lipgloss.Renderer, title string, headers []string, rows [][]string) string {
@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/acristoffers/dbkp/pkg/dbkp"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/muesli/termenv"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+var presetsCmd = &cobra.Command{
+	Use:   "presets",
+	Short: "Manages the built-in presets.",
+	Long:  `Manages the built-in presets, which can be added with dbkp add --preset NAME.`,
+}
+
+var presetsListCmd = &cobra.Command{
+	Use:   "list",
+	Args:  cobra.NoArgs,
+	Short: "Lists the built-in presets.",
+	Long:  `Lists the built-in presets, which can be added with dbkp add --preset NAME.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		machine, err := cmd.Flags().GetBool("machine")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not parse options: %s\n", err)
+			os.Exit(1)
+		}
+
+		presets, err := dbkp.Presets()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "An error ocurred: %s\n", err)
+			os.Exit(1)
+		}
+
+		if machine {
+			for _, preset := range presets {
+				fmt.Printf("%s\t%s\t%s\n", preset.Name, presetType(preset), preset.Description)
+			}
+			return
+		}
+
+		renderer := lipgloss.NewRenderer(os.Stdout)
+		if !term.IsTerminal(int(os.Stdout.Fd())) {
+			renderer.SetColorProfile(termenv.Ascii)
+		}
+		lipgloss.SetDefaultRenderer(renderer)
+
+		rows := make([][]string, 0, len(presets))
+		for _, preset := range presets {
+			rows = append(rows, []string{preset.Name, presetType(preset), preset.Description})
+		}
+
+		fmt.Println(renderTable(renderer, "Presets", []string{"Name", "Type", "Description"}, rows))
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(presetsCmd)
+	presetsCmd.AddCommand(presetsListCmd)
+	presetsListCmd.Flags().BoolP("machine", "m", false, "Machine-readable output using tab separators")
+}
+
+func presetType(preset dbkp.Preset) string {
+	if preset.Packages != nil {
+		return "Packages"
+	}
+	return "Command"
+}
+
+func completePresets(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	suggestions := []string{}
+
+	presets, err := dbkp.Presets()
+	if err != nil {
+		return suggestions, cobra.ShellCompDirectiveNoFileComp
+	}
+
+	for _, preset := range presets {
+		suggestions = append(suggestions, fmt.Sprintf("%s\t%s", preset.Name, preset.Description))
+	}
+
+	return suggestions, cobra.ShellCompDirectiveNoFileComp
+}
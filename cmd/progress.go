@@ -0,0 +1,106 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/acristoffers/dbkp/pkg/dbkp"
+	"github.com/schollz/progressbar/v3"
+	"golang.org/x/term"
+)
+
+// Longest current file shown in the progress bar description.
+const progressFileWidth = 32
+
+// Shows the progress of a backup or restore. Once the size of the files to be
+// copied is known, the bar counts bytes and shows the throughput and an ETA.
+// Otherwise, it counts entries.
+type progressView struct {
+	action string // What is being done to each entry, e.g.: "Backing up".
+	bar    *progressbar.ProgressBar
+	bytes  bool // Whether the bar counts bytes.
+	hidden bool // Whether stdout is not a terminal, so the bar is not shown.
+}
+
+func newProgressView(action string) *progressView {
+	view := &progressView{action: action, hidden: !term.IsTerminal(int(os.Stdout.Fd()))}
+	view.bar = view.newBar()
+	return view
+}
+
+func (view *progressView) newBar() *progressbar.ProgressBar {
+	options := []progressbar.Option{
+		progressbar.OptionSetWriter(os.Stdout),
+		progressbar.OptionThrottle(0),
+		progressbar.OptionFullWidth(),
+		progressbar.OptionSetRenderBlankState(true),
+		progressbar.OptionSetVisibility(!view.hidden),
+	}
+
+	if view.bytes {
+		options = append(options,
+			progressbar.OptionShowBytes(true),
+			progressbar.OptionShowCount(),
+			progressbar.OptionShowTotalBytes(true),
+			progressbar.OptionSetPredictTime(true))
+	} else {
+		options = append(options, progressbar.OptionShowCount())
+	}
+
+	return progressbar.NewOptions64(100, options...)
+}
+
+// Updates the bar with report.
+func (view *progressView) update(report dbkp.ProgressReport) {
+	if report.BytesTotal > 0 && !view.bytes {
+		view.bar.Clear()
+		view.bytes = true
+		view.bar = view.newBar()
+	}
+
+	view.bar.Describe(view.describe(report))
+
+	if !view.bytes {
+		view.bar.ChangeMax64(int64(report.Total))
+		view.bar.Set64(int64(report.Count))
+	} else if report.BytesTotal > 0 {
+		view.bar.ChangeMax64(int64(report.BytesTotal))
+		view.bar.Set64(int64(report.BytesDone))
+	}
+}
+
+func (view *progressView) describe(report dbkp.ProgressReport) string {
+	step := fmt.Sprintf("[%d/%d]", min(report.Count+1, report.Total), report.Total)
+
+	switch report.Phase {
+	case dbkp.PhaseScanning:
+		return fmt.Sprintf("Scanning %s", report.Name)
+	case dbkp.PhaseEncrypting:
+		return fmt.Sprintf("%s Encrypting %s", step, report.Name)
+	case dbkp.PhaseDecrypting:
+		return fmt.Sprintf("%s Decrypting %s", step, report.Name)
+	case dbkp.PhaseCopying:
+		if report.File != "" {
+			return fmt.Sprintf("%s %s %s: %s", step, view.action, report.Name, shortenPath(report.File))
+		}
+	}
+
+	return fmt.Sprintf("%s %s %s", step, view.action, report.Name)
+}
+
+// Hides the bar. view may be nil, if nothing was reported.
+func (view *progressView) clear() {
+	if view != nil {
+		view.bar.Clear()
+	}
+}
+
+// Keeps the end of path, which is usually the most telling part, if it is too
+// long for the bar description.
+func shortenPath(path string) string {
+	runes := []rune(path)
+	if len(runes) <= progressFileWidth {
+		return path
+	}
+	return "…" + string(runes[len(runes)-progressFileWidth+1:])
+}
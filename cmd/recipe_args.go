@@ -1,37 +1,138 @@
 package cmd
 
 import (
+	"errors"
+	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/spf13/cobra"
 )
 
-func resolveRecipePathAndNames(args []string) (string, []string, error) {
-	if len(args) == 0 {
-		path, err := filepath.Abs("./dbkp.toml")
-		return path, nil, err
+// The file name of recipes, looked for in the working directory and its
+// parents.
+const recipeFileName = "dbkp.toml"
+
+// Names the recipe to use, like --recipe.
+const recipeEnv = "DBKP_RECIPE"
+
+// The user configuration, in $XDG_CONFIG_HOME/dbkp/config.toml.
+type userConfig struct {
+	Recipe string // The recipe used when none is given and none is found from the working directory.
+}
+
+// Returns the recipe given with --recipe, or else with DBKP_RECIPE, as an
+// absolute path, or "" if none is.
+func givenRecipePath(cmd *cobra.Command) (string, error) {
+	path, err := cmd.Flags().GetString("recipe")
+	if err != nil {
+		return "", err
+	}
+
+	if path == "" {
+		path = os.Getenv(recipeEnv)
+	}
+
+	if path == "" {
+		return "", nil
+	}
+
+	return absRecipePath(path, ".")
+}
+
+// Returns the recipe to use: the one given with --recipe or DBKP_RECIPE, or
+// else the first dbkp.toml found in the working directory or its parents, or
+// else the Recipe of the user configuration, or else ./dbkp.toml.
+func findRecipePath(cmd *cobra.Command) (string, error) {
+	if path, err := givenRecipePath(cmd); err != nil || path != "" {
+		return path, err
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+
+	for dir := wd; ; dir = filepath.Dir(dir) {
+		path := filepath.Join(dir, recipeFileName)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+
+		if filepath.Dir(dir) == dir {
+			break
+		}
 	}
 
-	if looksLikeTomlPath(args[0]) {
+	config, configPath, err := loadUserConfig()
+	if err != nil {
+		return "", err
+	}
+
+	if config.Recipe != "" {
+		return absRecipePath(config.Recipe, filepath.Dir(configPath))
+	}
+
+	return filepath.Join(wd, recipeFileName), nil
+}
+
+// Returns the recipe and the names in args. The recipe may be given as the
+// first argument, if it ends in .toml, or else it is found by findRecipePath.
+func resolveRecipePathAndNames(cmd *cobra.Command, args []string) (string, []string, error) {
+	if len(args) > 0 && strings.HasSuffix(args[0], ".toml") {
+		if cmd.Flags().Changed("recipe") {
+			return "", nil, errors.New("the recipe is given both with --recipe and as an argument")
+		}
+
 		path, err := filepath.Abs(args[0])
+		return path, args[1:], err
+	}
+
+	path, err := findRecipePath(cmd)
+	return path, args, err
+}
+
+// Returns path absolute, with ~ expanded and relative to dir. Folders are
+// taken as the dbkp.toml inside them.
+func absRecipePath(path string, dir string) (string, error) {
+	if rest, ok := strings.CutPrefix(path, "~/"); ok {
+		home, err := os.UserHomeDir()
 		if err != nil {
-			return "", nil, err
+			return "", err
 		}
-		return path, args[1:], nil
+		path = filepath.Join(home, rest)
+	} else if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
 	}
 
-	path, err := filepath.Abs("./dbkp.toml")
-	return path, args, err
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		path = filepath.Join(path, recipeFileName)
+	}
+
+	return filepath.Abs(path)
 }
 
-func looksLikeTomlPath(value string) bool {
-	if strings.HasSuffix(value, ".toml") {
-		return true
+// Loads the user configuration and returns it with its path. A missing file
+// is an empty configuration.
+func loadUserConfig() (userConfig, string, error) {
+	config := userConfig{}
+
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return config, "", err
+		}
+		dir = filepath.Join(home, ".config")
 	}
 
-	if _, err := os.Stat(value); err == nil {
-		return true
+	path := filepath.Join(dir, "dbkp", "config.toml")
+	if _, err := toml.DecodeFile(path, &config); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return config, path, fmt.Errorf("%s: %w", path, err)
 	}
 
-	return false
+	return config, path, nil
 }
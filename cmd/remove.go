@@ -3,7 +3,6 @@ package cmd
 import (
 	"fmt"
 	"os"
-	"path/filepath"
 	"slices"
 	"strings"
 
@@ -15,11 +14,14 @@ var removeCmd = &cobra.Command{
 	Use:   "remove",
 	Args:  cobra.MinimumNArgs(1),
 	Short: "Removes and entry from the backup recipe",
-	Long:  `Removes NAMEs from dbkp.toml.`,
+	Long: `Removes NAMEs from dbkp.toml.
+
+    The data already stored in the backup is kept, unless --purge is given.
+    Encrypted backups are rewritten by --purge and ask for the password.`,
 	ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
 		suggestions := []string{}
 
-		path, err := filepath.Abs("./dbkp.toml")
+		path, err := findRecipePath(cmd)
 		if err != nil {
 			return suggestions, cobra.ShellCompDirectiveNoFileComp
 		}
@@ -40,10 +42,22 @@ var removeCmd = &cobra.Command{
 			}
 		}
 
+		for _, set := range recipe.Packages {
+			if strings.HasPrefix(set.Name, toComplete) && !slices.Contains(args, set.Name) {
+				suggestions = append(suggestions, set.Name)
+			}
+		}
+
 		return suggestions, cobra.ShellCompDirectiveNoFileComp
 	},
 	Run: func(cmd *cobra.Command, args []string) {
-		path, err := filepath.Abs("./dbkp.toml")
+		purge, err := cmd.Flags().GetBool("purge")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not parse options: %s\n", err)
+			os.Exit(1)
+		}
+
+		path, err := findRecipePath(cmd)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Could not get recipe path: %s\n", err)
 			os.Exit(1)
@@ -51,10 +65,21 @@ var removeCmd = &cobra.Command{
 
 		recipe, err := dbkp.LoadRecipe(path)
 		if err != nil {
-			fmt.Printf("Cannot open file %s: %s\n", "./dbkp.toml", err)
+			fmt.Printf("Cannot open file %s: %s\n", path, err)
 			os.Exit(1)
 		}
 
+		for _, name := range args {
+			known := slices.ContainsFunc(recipe.Files, func(file dbkp.File) bool { return file.Name == name }) ||
+				slices.ContainsFunc(recipe.Commands, func(command dbkp.Command) bool { return command.Name == name }) ||
+				slices.ContainsFunc(recipe.Packages, func(set dbkp.PackageSet) bool { return set.Name == name })
+			if !known {
+				err := fmt.Errorf("%w: %s", dbkp.ErrUnknownEntry, name)
+				fmt.Fprintf(os.Stderr, "An error ocurred: %s\n", err)
+				os.Exit(exitCode(err))
+			}
+		}
+
 		keepFiles := []dbkp.File{}
 	fileLoop:
 		for _, file := range recipe.Files {
@@ -79,7 +104,27 @@ var removeCmd = &cobra.Command{
 		}
 		recipe.Commands = keepCmd
 
-		if err := recipe.WriteRecipe(path); err != nil {
+		keepPackages := []dbkp.PackageSet{}
+	packagesLoop:
+		for _, set := range recipe.Packages {
+			for _, name := range args {
+				if set.Name == name {
+					continue packagesLoop
+				}
+			}
+			keepPackages = append(keepPackages, set)
+		}
+		recipe.Packages = keepPackages
+
+		if purge {
+			if err := dbkp.Purge(path, recipe, args, dbkp.AskForPassword); err != nil {
+				fmt.Fprintf(os.Stderr, "An error ocurred: %s\n", err)
+				os.Exit(exitCode(err))
+			}
+			return
+		}
+
+		if err := dbkp.SaveRecipe(path, recipe); err != nil {
 			fmt.Fprintf(os.Stderr, "Cannot open file %s: %s\n", path, err)
 			os.Exit(1)
 		}
@@ -88,4 +133,5 @@ var removeCmd = &cobra.Command{
 
 func init() {
 	RootCmd.AddCommand(removeCmd)
+	removeCmd.Flags().Bool("purge", false, "Also deletes the data stored in the backup for these entries")
 }
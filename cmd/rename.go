@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/acristoffers/dbkp/pkg/dbkp"
+	"github.com/spf13/cobra"
+)
+
+var renameCmd = &cobra.Command{
+	Use:   "rename OLD NEW",
+	Args:  cobra.ExactArgs(2),
+	Short: "Renames an entry of the recipe and of the backup",
+	Long: `Renames the entry OLD of dbkp.toml to NEW.
+
+    The data already stored in the backup is moved as well, so that it is still
+    restored under the new name. Encrypted backups are rewritten and ask for
+    the password.`,
+	ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		suggestions := []string{}
+		if len(args) > 0 {
+			return suggestions, cobra.ShellCompDirectiveNoFileComp
+		}
+
+		path, err := findRecipePath(cmd)
+		if err != nil {
+			return suggestions, cobra.ShellCompDirectiveNoFileComp
+		}
+
+		recipe, err := dbkp.LoadRecipe(path)
+		if err != nil {
+			return suggestions, cobra.ShellCompDirectiveNoFileComp
+		}
+
+		for _, file := range recipe.Files {
+			if strings.HasPrefix(file.Name, toComplete) {
+				suggestions = append(suggestions, file.Name)
+			}
+		}
+
+		for _, command := range recipe.Commands {
+			if strings.HasPrefix(command.Name, toComplete) {
+				suggestions = append(suggestions, command.Name)
+			}
+		}
+
+		for _, set := range recipe.Packages {
+			if strings.HasPrefix(set.Name, toComplete) {
+				suggestions = append(suggestions, set.Name)
+			}
+		}
+
+		return suggestions, cobra.ShellCompDirectiveNoFileComp
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		recipePath, err := findRecipePath(cmd)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not get recipe path: %s\n", err)
+			os.Exit(1)
+		}
+
+		recipe, err := dbkp.LoadRecipe(recipePath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot open file %s: %s\n", recipePath, err)
+			os.Exit(1)
+		}
+
+		if err := dbkp.Rename(recipePath, recipe, args[0], args[1], dbkp.AskForPassword); err != nil {
+			fmt.Fprintf(os.Stderr, "An error ocurred: %s\n", err)
+			os.Exit(exitCode(err))
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(renameCmd)
+}
@@ -1,14 +1,16 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"runtime"
 	"slices"
 	"strings"
 
 	"github.com/acristoffers/dbkp/pkg/dbkp"
-	"github.com/schollz/progressbar/v3"
 	"github.com/spf13/cobra"
 )
 
@@ -19,7 +21,7 @@ var restoreCmd = &cobra.Command{
 	ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
 		suggestions := []string{}
 
-		recipePath, names, err := resolveRecipePathAndNames(args)
+		recipePath, names, err := resolveRecipePathAndNames(cmd, args)
 		if err != nil {
 			return suggestions, cobra.ShellCompDirectiveNoFileComp
 		}
@@ -41,10 +43,45 @@ var restoreCmd = &cobra.Command{
 			}
 		}
 
+		for _, set := range recipe.Packages {
+			if strings.HasPrefix(set.Name, toComplete) && !slices.Contains(names, set.Name) {
+				suggestions = append(suggestions, set.Name)
+			}
+		}
+
 		return suggestions, cobra.ShellCompDirectiveNoFileComp
 	},
 	Run: func(cmd *cobra.Command, args []string) {
-		recipePath, names, err := resolveRecipePathAndNames(args)
+		output, err := cmd.Flags().GetString("output")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not parse options: %s\n", err)
+			os.Exit(1)
+		}
+
+		if err := checkOutput(output); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not parse options: %s\n", err)
+			os.Exit(1)
+		}
+
+		jobs, err := cmd.Flags().GetInt("jobs")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not parse options: %s\n", err)
+			os.Exit(1)
+		}
+
+		dryRun, err := cmd.Flags().GetBool("dry-run")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not parse options: %s\n", err)
+			os.Exit(1)
+		}
+
+		conflict, err := cmd.Flags().GetString("conflict")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not parse options: %s\n", err)
+			os.Exit(1)
+		}
+
+		recipePath, names, err := resolveRecipePathAndNames(cmd, args)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "An error ocurred: %s\n", err)
 			os.Exit(1)
@@ -58,44 +95,78 @@ var restoreCmd = &cobra.Command{
 			os.Exit(1)
 		}
 
-		password := []byte{}
-		if len(recipe.EncryptionSalt) > 0 && len(recipe.EncryptionSalt[0]) > 0 {
-			password, err = dbkp.AskForPassword()
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+
+		var view *progressView
+		var events *eventWriter
+		if output == outputJSON && !dryRun {
+			events = newEventWriter("restore")
+		}
+
+		report, err := dbkp.Restore(ctx, dbkp.Options{
+			Path:     path,
+			Recipe:   recipe,
+			Names:    names,
+			Password: dbkp.AskForPassword,
+			Jobs:     jobs,
+			DryRun:   dryRun,
+			Conflict: conflict,
+			Progress: func(r dbkp.ProgressReport) {
+				if events != nil {
+					events.report(r)
+					return
+				}
+
+				if view == nil {
+					view = newProgressView("Restoring")
+				}
+				view.update(r)
+			},
+		})
+
+		if dryRun {
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "An error ocurred: %s\n", err)
-				os.Exit(1)
+				os.Exit(exitCode(err))
 			}
-		} else {
-			password = nil
-		}
-
-		bar := progressbar.NewOptions(100,
-			progressbar.OptionSetWriter(os.Stdout),
-			progressbar.OptionThrottle(0),
-			progressbar.OptionShowCount(),
-			progressbar.OptionFullWidth(),
-			progressbar.OptionSetRenderBlankState(true))
 
-		channel := make(chan dbkp.ProgressReport)
+			if output == outputJSON {
+				writePackagePlans(report.Plans)
+			} else {
+				printPackagePlans(report.Plans)
+			}
+			return
+		}
 
-		go func() {
-			if err := dbkp.RestoreSelected(path, recipe, password, channel, names); err != nil {
-				bar.Clear()
-				fmt.Fprintf(os.Stderr, "An error ocurred: %s\n", err)
-				os.Exit(1)
+		if events != nil {
+			events.summary(err)
+			if err != nil {
+				os.Exit(exitCode(err))
 			}
-		}()
+			return
+		}
 
-		for c := range channel {
-			bar.ChangeMax64(int64(c.Total))
-			bar.Describe(fmt.Sprintf("Restoring %s", c.Name))
-			bar.Set64(int64(c.Count))
+		view.clear()
+		for _, entry := range report.Entries {
+			if entry.Message != "" {
+				fmt.Printf("%s: %s\n", entry.Name, entry.Message)
+			}
 		}
+		printSkipped(report.Skipped)
+		printFailures(report.Failures)
 
-		bar.Clear()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "An error ocurred: %s\n", err)
+			os.Exit(exitCode(err))
+		}
 	},
 }
 
 func init() {
 	RootCmd.AddCommand(restoreCmd)
+	restoreCmd.Flags().StringP("output", "O", outputText, "Output format: text, or json for newline-delimited JSON events")
+	restoreCmd.Flags().IntP("jobs", "j", runtime.NumCPU(), "Number of entries processed at the same time")
+	restoreCmd.Flags().Bool("dry-run", false, "Shows what restoring the packages would install and remove, without changing anything")
+	restoreCmd.Flags().String("conflict", dbkp.ConflictOverwrite, "What to do with files that already exist: overwrite, skip, or backup to rename them with a .dbkp-orig suffix if they differ")
 }
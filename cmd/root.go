@@ -25,6 +25,11 @@ var RootCmd = &cobra.Command{
       dbkp add ~/.config/fish
       dbkp add ~/bin
       dbkp backup
+
+    Commands use the recipe given with --recipe or the DBKP_RECIPE variable.
+    Otherwise they look for dbkp.toml in the current folder and its parents,
+    like git does, and then use the Recipe set in
+    $XDG_CONFIG_HOME/dbkp/config.toml, if any.
     `,
 	Run: func(cmd *cobra.Command, args []string) {
 		version, err := cmd.Flags().GetBool("version")
@@ -49,4 +54,6 @@ func Execute() {
 
 func init() {
 	RootCmd.Flags().BoolP("version", "v", false, "Prints version")
+	RootCmd.PersistentFlags().String("recipe", "", "The recipe to use, or a folder containing dbkp.toml. Defaults to $DBKP_RECIPE")
+	RootCmd.MarkPersistentFlagFilename("recipe", "toml")
 }
@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/acristoffers/dbkp/pkg/dbkp"
+	"github.com/spf13/cobra"
+)
+
+var scanCmd = &cobra.Command{
+	Use:   "scan [dbkp.toml] [name ...]",
+	Short: "Scans an unencrypted backup for secrets.",
+	Long: `Scans the files in the dbkp folder of an unencrypted backup for private keys,
+    tokens and other high-entropy strings that should not be committed.
+
+    The AllowSecrets entries of the recipe are respected. Exits with an error if
+    anything is found.`,
+	ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		suggestions := []string{}
+
+		recipePath, names, err := resolveRecipePathAndNames(cmd, args)
+		if err != nil {
+			return suggestions, cobra.ShellCompDirectiveNoFileComp
+		}
+
+		recipe, err := dbkp.LoadRecipe(recipePath)
+		if err != nil {
+			return suggestions, cobra.ShellCompDirectiveNoFileComp
+		}
+
+		for _, file := range recipe.Files {
+			if strings.HasPrefix(file.Name, toComplete) && !slices.Contains(names, file.Name) {
+				suggestions = append(suggestions, file.Name)
+			}
+		}
+
+		for _, command := range recipe.Commands {
+			if strings.HasPrefix(command.Name, toComplete) && !slices.Contains(names, command.Name) {
+				suggestions = append(suggestions, command.Name)
+			}
+		}
+
+		for _, set := range recipe.Packages {
+			if strings.HasPrefix(set.Name, toComplete) && !slices.Contains(names, set.Name) {
+				suggestions = append(suggestions, set.Name)
+			}
+		}
+
+		return suggestions, cobra.ShellCompDirectiveNoFileComp
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		recipePath, names, err := resolveRecipePathAndNames(cmd, args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "An error ocurred: %s\n", err)
+			os.Exit(1)
+		}
+
+		recipe, err := dbkp.LoadRecipe(recipePath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "An error ocurred: %s\n", err)
+			os.Exit(1)
+		}
+
+		findings, err := dbkp.ScanBackup(filepath.Dir(recipePath), recipe, names)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "An error ocurred: %s\n", err)
+			os.Exit(exitCode(err))
+		}
+
+		if len(findings) == 0 {
+			fmt.Println("No secrets found.")
+			return
+		}
+
+		printSecrets(findings)
+		os.Exit(1)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(scanCmd)
+}
@@ -0,0 +1,95 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/acristoffers/dbkp/pkg/dbkp"
+)
+
+// Prints the files skipped during a backup or restore, grouped by entry.
+func printSkipped(skipped []dbkp.SkippedFile) {
+	if len(skipped) == 0 {
+		return
+	}
+
+	fmt.Printf("Skipped %d file(s):\n", len(skipped))
+
+	entry := ""
+	for _, file := range skipped {
+		if file.Entry != entry {
+			entry = file.Entry
+			fmt.Printf("  %s\n", entry)
+		}
+
+		path := file.Path
+		if path == "" {
+			path = "."
+		}
+
+		fmt.Printf("    %s: %s\n", path, file.Reason)
+	}
+}
+
+// Prints the possible secrets found in an unencrypted backup.
+func printSecrets(findings []dbkp.SecretFinding) {
+	if len(findings) == 0 {
+		return
+	}
+
+	fmt.Printf("Possible secrets found in %d place(s):\n", len(findings))
+
+	for _, finding := range findings {
+		path := finding.Entry
+		if finding.Path != "" && finding.Path != finding.Entry {
+			path = finding.Entry + "/" + finding.Path
+		}
+
+		fmt.Printf("  %s:%d: %s %s\n", path, finding.Line, finding.Rule, finding.Match)
+	}
+}
+
+// Prints the commands that failed without aborting the backup or restore.
+func printFailures(failures []dbkp.CommandFailure) {
+	if len(failures) == 0 {
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "%d command(s) failed:\n", len(failures))
+
+	for _, failure := range failures {
+		if failure.Package != "" {
+			fmt.Fprintf(os.Stderr, "  %s (%s): %s\n", failure.Entry, failure.Package, failure.Error)
+		} else {
+			fmt.Fprintf(os.Stderr, "  %s: %s\n", failure.Entry, failure.Error)
+		}
+
+		stderr := strings.TrimSpace(failure.Stderr)
+		if stderr == "" {
+			continue
+		}
+
+		for line := range strings.SplitSeq(stderr, "\n") {
+			fmt.Fprintf(os.Stderr, "    %s\n", line)
+		}
+	}
+}
+
+// Prints what restoring the PackageSets would install and remove.
+func printPackagePlans(plans []dbkp.PackagePlan) {
+	for _, plan := range plans {
+		if plan.Empty() {
+			fmt.Printf("%s: already up to date\n", plan.Entry)
+			continue
+		}
+
+		fmt.Printf("%s:\n", plan.Entry)
+		for _, name := range plan.Install {
+			fmt.Printf("  + %s\n", name)
+		}
+		for _, name := range plan.Remove {
+			fmt.Printf("  - %s\n", name)
+		}
+	}
+}
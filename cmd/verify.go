@@ -0,0 +1,148 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/acristoffers/dbkp/pkg/dbkp"
+	"github.com/spf13/cobra"
+)
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify [dbkp.toml] [name ...]",
+	Short: "Checks the backup against its manifest.",
+	Long: `Reads every file of the backup and checks it against the manifest written
+    when the backup was made, reporting missing, extra and corrupted files.
+
+    With --deep, the files and commands are also restored into a temporary
+    directory, commands being replaced by a stub capturing their input, and
+    the result is compared with the manifest, including permissions.
+
+    Exits with an error if anything differs.`,
+	ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		suggestions := []string{}
+
+		recipePath, names, err := resolveRecipePathAndNames(cmd, args)
+		if err != nil {
+			return suggestions, cobra.ShellCompDirectiveNoFileComp
+		}
+
+		recipe, err := dbkp.LoadRecipe(recipePath)
+		if err != nil {
+			return suggestions, cobra.ShellCompDirectiveNoFileComp
+		}
+
+		for _, file := range recipe.Files {
+			if strings.HasPrefix(file.Name, toComplete) && !slices.Contains(names, file.Name) {
+				suggestions = append(suggestions, file.Name)
+			}
+		}
+
+		for _, command := range recipe.Commands {
+			if strings.HasPrefix(command.Name, toComplete) && !slices.Contains(names, command.Name) {
+				suggestions = append(suggestions, command.Name)
+			}
+		}
+
+		for _, set := range recipe.Packages {
+			if strings.HasPrefix(set.Name, toComplete) && !slices.Contains(names, set.Name) {
+				suggestions = append(suggestions, set.Name)
+			}
+		}
+
+		return suggestions, cobra.ShellCompDirectiveNoFileComp
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		deep, err := cmd.Flags().GetBool("deep")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not parse options: %s\n", err)
+			os.Exit(1)
+		}
+
+		recipePath, names, err := resolveRecipePathAndNames(cmd, args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "An error ocurred: %s\n", err)
+			os.Exit(1)
+		}
+
+		recipe, err := dbkp.LoadRecipe(recipePath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "An error ocurred: %s\n", err)
+			os.Exit(1)
+		}
+
+		var password []byte
+		if recipe.NeedsPassword(names) {
+			password, err = dbkp.AskForPassword()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "An error ocurred: %s\n", err)
+				os.Exit(1)
+			}
+		}
+
+		path := filepath.Dir(recipePath)
+
+		manifest, problems, err := dbkp.Verify(path, recipe, password, names)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "An error ocurred: %s\n", err)
+			os.Exit(exitCode(err))
+		}
+
+		fmt.Printf("Backup made by dbkp %s on %s at %s.\n", manifest.Version, manifest.Hostname, manifest.Created.Format("2006-01-02 15:04:05"))
+
+		for _, entry := range manifest.Entries {
+			if entry.Skipped && (len(names) == 0 || slices.Contains(names, entry.Name)) {
+				fmt.Printf("%s was skipped, as its backup failed. It will not be restored.\n", entry.Name)
+			}
+		}
+
+		if deep && len(problems) > 0 {
+			fmt.Println("Skipping the test restore, as the backup does not match its manifest.")
+		} else if deep {
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+			defer stop()
+
+			problems, err = dbkp.VerifyRestore(ctx, path, recipe, password, manifest, names)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "An error ocurred: %s\n", err)
+				os.Exit(exitCode(err))
+			}
+		}
+
+		if len(problems) == 0 {
+			fmt.Println("The backup matches its manifest.")
+			return
+		}
+
+		printVerifyProblems(problems)
+		os.Exit(exitCorrupt)
+	},
+}
+
+// Prints the differences between a backup and its manifest.
+func printVerifyProblems(problems []dbkp.VerifyProblem) {
+	fmt.Printf("Found %d problem(s):\n", len(problems))
+
+	for _, problem := range problems {
+		path := problem.Entry
+		if problem.Path != "" {
+			path = problem.Entry + "/" + problem.Path
+		}
+
+		if problem.Restored {
+			fmt.Printf("  %s: %s after restore\n", path, problem.Problem)
+		} else {
+			fmt.Printf("  %s: %s\n", path, problem.Problem)
+		}
+	}
+}
+
+func init() {
+	RootCmd.AddCommand(verifyCmd)
+	verifyCmd.Flags().Bool("deep", false, "Also restores the backup into a temporary directory and checks the result")
+}
@@ -0,0 +1,347 @@
+package dbkp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+)
+
+// Values of Options.Conflict.
+const (
+	ConflictOverwrite = "overwrite" // Replace files that already exist. The default.
+	ConflictSkip      = "skip"      // Keep files that already exist, reporting them as skipped.
+	ConflictBackup    = "backup"    // Rename files that already exist and differ, appending ".dbkp-orig" (then ".dbkp-orig.1", ...) to their names.
+)
+
+// Appended to the names of the files renamed by ConflictBackup.
+const conflictBackupSuffix = ".dbkp-orig"
+
+// Values of EntryResult.Status.
+const (
+	EntryDone    = "done"    // The entry was backed up or restored.
+	EntryFailed  = "failed"  // The entry failed, see EntryResult.Error.
+	EntryNotRun  = "not run" // The entry was not started, because another one failed or the run was cancelled.
+	EntryPlanned = "planned" // The entry would be processed, in dry runs.
+)
+
+// The settings of a backup or restore.
+type Options struct {
+	Path       string                 // The folder of the recipe. The backup is stored in a file or folder named dbkp in it, or in the Destination of the recipe or entry.
+	RecipeFile string                 // The recipe file encrypted backups save EncryptionSalt to. Path/dbkp.toml if empty.
+	Recipe     Recipe                 // The recipe describing the backup.
+	Names      []string               // The entries to process. If empty, all of them.
+	Password   func() ([]byte, error) // Called at most once, if the selected entries need a password.
+	Progress   func(ProgressReport)   // If non-nil, called with each report, in order and from a single goroutine.
+	Jobs       int                    // The number of entries processed at the same time, or one per CPU if not positive.
+	DryRun     bool                   // Only reports what would be done, without changing anything.
+	Conflict   string                 // What a restore does with files that already exist: ConflictOverwrite (the default), ConflictSkip or ConflictBackup.
+}
+
+// The outcome of an entry of a backup or restore.
+type EntryResult struct {
+	Name     string
+	Kind     string        // file, command or packages.
+	Status   string        // EntryDone, EntryFailed, EntryNotRun or EntryPlanned.
+	Message  string        // The last message about the entry, e.g.: "already up to date".
+	Error    error         // Why the entry failed, if Status is EntryFailed.
+	Duration time.Duration // How long the entry took, if it was run.
+}
+
+// What happened during a backup or restore.
+type Report struct {
+	Entries    []EntryResult    // One per selected entry, in the order of the recipe.
+	Skipped    []SkippedFile    // Files that were not copied.
+	Secrets    []SecretFinding  // Possible secrets found in unencrypted backups.
+	Failures   []CommandFailure // Commands that failed but whose OnFailure policy let the run go on.
+	Plans      []PackagePlan    // What restoring each PackageSet would do, in dry-run restores.
+	BytesDone  uint64           // The bytes of File entries copied.
+	BytesTotal uint64           // The bytes of File entries to be copied, or 0 if unknown.
+	Duration   time.Duration    // How long the whole run took.
+}
+
+// Returns the result of the entry name, or nil if it is not in the report.
+func (report *Report) Entry(name string) *EntryResult {
+	for i := range report.Entries {
+		if report.Entries[i].Name == name {
+			return &report.Entries[i]
+		}
+	}
+	return nil
+}
+
+// Returns the recipe file EncryptionSalt is saved to.
+func (options Options) recipeFile() string {
+	if options.RecipeFile != "" {
+		return options.RecipeFile
+	}
+	return filepath.Join(options.Path, "dbkp.toml")
+}
+
+// Backs up the selected entries of options.Recipe into options.Path/dbkp, or
+// into the dbkp folder of their Destination. The backup is encrypted if the
+// recipe is, otherwise only the entries with Encrypt set are. Cancelling ctx
+// stops the commands being run and the files being copied, and no other
+// entries are started.
+func Backup(ctx context.Context, options Options) (Report, error) {
+	selected, err := filterRecipeByNames(options.Recipe, options.Names)
+	if err != nil {
+		return Report{}, err
+	}
+
+	groups, err := destinationGroups(options.Path, options.Recipe, selected)
+	if err != nil {
+		return Report{}, err
+	}
+
+	// Entries kept elsewhere are backed up apart. A full backup replaces
+	// the backup of each destination.
+	partial := len(options.Names) > 0
+	options.RecipeFile = options.recipeFile()
+	if len(groups) > 1 {
+		return runInDestinations(options, selected, groups, func(options Options, path string) (Report, error) {
+			return backupTo(ctx, options, path, partial)
+		})
+	}
+
+	if err := groups[0].check(); err != nil {
+		return Report{}, err
+	}
+
+	return backupTo(ctx, options, groups[0].path, partial)
+}
+
+// Backs up the selected entries of options.Recipe into path/dbkp. If partial
+// is set, the other entries stored there are kept.
+func backupTo(ctx context.Context, options Options, path string, partial bool) (Report, error) {
+	selected, err := filterRecipeByNames(options.Recipe, options.Names)
+	if err != nil {
+		return Report{}, err
+	}
+
+	report := newReport(selected)
+	if options.DryRun {
+		for _, file := range selected.Files {
+			size, _ := measureBackup(options.Recipe, file)
+			report.BytesTotal += size
+		}
+		report.plan()
+		return report, nil
+	}
+
+	password, err := options.password()
+	if err != nil {
+		return report, err
+	}
+
+	return report.collect(options.Progress, func(pr chan<- ProgressReport) error {
+		if password != nil && (options.Recipe.Encrypted() || !selected.hasEncryptedEntries()) {
+			return backupEncrypted(ctx, path, options.RecipeFile, options.Recipe, selected, password, pr, partial, options.Jobs)
+		}
+		return backupPlain(ctx, path, selected, password, pr, partial, options.Jobs)
+	})
+}
+
+// Restores the selected entries of options.Recipe from options.Path/dbkp, or
+// from the dbkp folder of their Destination. Commands and Packages only start
+// after every File is restored, as they may depend on them. Dry runs compute
+// what would be done to the PackageSets. Cancelling ctx stops the commands
+// being run and the files being copied, and no other entries are started.
+func Restore(ctx context.Context, options Options) (Report, error) {
+	switch options.Conflict {
+	case "", ConflictOverwrite, ConflictSkip, ConflictBackup:
+	default:
+		return Report{}, fmt.Errorf("unknown conflict policy %q", options.Conflict)
+	}
+
+	selected, err := filterRecipeByNames(options.Recipe, options.Names)
+	if err != nil {
+		return Report{}, err
+	}
+
+	groups, err := destinationGroups(options.Path, options.Recipe, selected)
+	if err != nil {
+		return Report{}, err
+	}
+
+	if len(groups) == 1 {
+		if err := groups[0].check(); err != nil {
+			return Report{}, err
+		}
+
+		return restoreFrom(ctx, options, groups[0].path)
+	}
+
+	// The Files of every destination go first.
+	phases := []destinationGroup{}
+	for _, group := range groups {
+		files := destinationGroup{path: group.path, set: group.set}
+		for _, name := range group.names {
+			if selected.file(name) != nil {
+				files.names = append(files.names, name)
+			}
+		}
+		phases = append(phases, files)
+	}
+
+	for _, group := range groups {
+		others := destinationGroup{path: group.path, set: group.set}
+		for _, name := range group.names {
+			if selected.file(name) == nil {
+				others.names = append(others.names, name)
+			}
+		}
+		phases = append(phases, others)
+	}
+
+	return runInDestinations(options, selected, phases, func(options Options, path string) (Report, error) {
+		return restoreFrom(ctx, options, path)
+	})
+}
+
+// Restores the selected entries of options.Recipe from path/dbkp.
+func restoreFrom(ctx context.Context, options Options, path string) (Report, error) {
+	selected, err := filterRecipeByNames(options.Recipe, options.Names)
+	if err != nil {
+		return Report{}, err
+	}
+
+	backupPath, err := filepath.Abs(filepath.Join(path, "dbkp"))
+	if err != nil {
+		return Report{}, err
+	}
+
+	report := newReport(selected)
+	if options.DryRun {
+		var password []byte
+		if len(selected.Packages) > 0 && options.Recipe.Encrypted() {
+			password, err = options.password()
+			if err != nil {
+				return report, err
+			}
+		}
+
+		report.Plans, err = planPackages(ctx, backupPath, selected, password)
+		if err != nil {
+			return report, err
+		}
+
+		report.plan()
+		return report, nil
+	}
+
+	password, err := options.password()
+	if err != nil {
+		return report, err
+	}
+
+	return report.collect(options.Progress, func(pr chan<- ProgressReport) error {
+		if password != nil && options.Recipe.Encrypted() {
+			return restoreEncrypt(ctx, backupPath, selected, password, pr, options.Jobs, options.Conflict)
+		}
+		return restorePlain(ctx, backupPath, selected, password, pr, options.Jobs, options.Conflict)
+	})
+}
+
+// Returns the password, if the selected entries need one.
+func (options Options) password() ([]byte, error) {
+	if !options.Recipe.NeedsPassword(options.Names) {
+		return nil, nil
+	}
+
+	if options.Password == nil {
+		return nil, errors.New("a password is needed, but none was given")
+	}
+
+	return options.Password()
+}
+
+// Creates a report with an EntryNotRun result for each entry of recipe.
+func newReport(recipe Recipe) Report {
+	report := Report{}
+
+	for _, file := range recipe.Files {
+		report.Entries = append(report.Entries, EntryResult{Name: file.Name, Kind: "file", Status: EntryNotRun})
+	}
+
+	for _, command := range recipe.Commands {
+		report.Entries = append(report.Entries, EntryResult{Name: command.Name, Kind: "command", Status: EntryNotRun})
+	}
+
+	for _, set := range recipe.Packages {
+		report.Entries = append(report.Entries, EntryResult{Name: set.Name, Kind: "packages", Status: EntryNotRun})
+	}
+
+	return report
+}
+
+// Marks every entry as planned.
+func (report *Report) plan() {
+	for i := range report.Entries {
+		report.Entries[i].Status = EntryPlanned
+	}
+}
+
+// Runs start, passing each report it sends to progress and collecting them.
+// start must close the channel when it returns.
+func (report *Report) collect(progress func(ProgressReport), start func(pr chan<- ProgressReport) error) (Report, error) {
+	begin := time.Now()
+
+	pr := make(chan ProgressReport)
+	result := make(chan error, 1)
+	go func() {
+		result <- start(pr)
+	}()
+
+	for r := range pr {
+		report.add(r)
+		if progress != nil {
+			progress(r)
+		}
+	}
+
+	err := <-result
+	report.Duration = time.Since(begin)
+	return *report, err
+}
+
+// Records r in the report.
+func (report *Report) add(r ProgressReport) {
+	if r.Skipped != nil {
+		report.Skipped = append(report.Skipped, *r.Skipped)
+	}
+
+	if r.Secret != nil {
+		report.Secrets = append(report.Secrets, *r.Secret)
+	}
+
+	if r.Failure != nil {
+		report.Failures = append(report.Failures, *r.Failure)
+	}
+
+	// Reports are sent concurrently, so the byte counts may arrive out of
+	// order.
+	if r.BytesTotal > 0 {
+		report.BytesTotal = r.BytesTotal
+		report.BytesDone = max(report.BytesDone, r.BytesDone)
+	}
+
+	entry := report.Entry(r.Name)
+	if entry == nil {
+		return
+	}
+
+	if r.Message != "" {
+		entry.Message = r.Message
+	}
+
+	if r.Finished {
+		entry.Status = EntryDone
+		entry.Error = r.Error
+		entry.Duration = r.Duration
+		if r.Error != nil {
+			entry.Status = EntryFailed
+		}
+	}
+}
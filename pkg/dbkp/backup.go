@@ -2,147 +2,312 @@ package dbkp
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io/fs"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 )
 
-// Executes the backup of the recipe into path/dbkp. If a password is given,
-// make it an encrypted backup.
-func Backup(path string, recipe Recipe, password []byte, pr chan<- ProgressReport) error {
-	return BackupSelected(path, recipe, password, pr, nil)
-}
-
-// Executes the backup of the selected names into path/dbkp. If names is empty,
-// it behaves like a full backup.
+// Executes the backup of the selected names into path/dbkp, sending progress
+// reports to pr and closing it when done. If names is empty, it behaves like a
+// full backup. If a password is given, make it an encrypted backup, unless the
+// recipe is not encrypted and has entries with Encrypt set, in which case only
+// those are encrypted. It is a thin wrapper around Backup, with the default
+// number of jobs.
 func BackupSelected(path string, recipe Recipe, password []byte, pr chan<- ProgressReport, names []string) error {
-	selectedRecipe, err := filterRecipeByNames(recipe, names)
-	if err != nil {
-		return err
+	if pr != nil {
+		defer close(pr)
 	}
 
-	partial := len(names) > 0
-	if password != nil {
-		return backupEncrypted(path, recipe, selectedRecipe, password, pr, partial)
+	if password != nil && !recipe.NeedsPassword(names) {
+		recipe.EnableEncryption()
 	}
 
-	return backupPlain(path, selectedRecipe, pr, partial)
+	_, err := Backup(context.Background(), Options{
+		Path:     path,
+		Recipe:   recipe,
+		Names:    names,
+		Password: func() ([]byte, error) { return password, nil },
+		Progress: sendTo(pr),
+	})
+	return err
 }
 
 // Executes a plain file backup (without encryption). pr is called before
 // attempting to execute the backup of file/folder/command, if it is non-nil.
-func backupPlain(path string, recipe Recipe, pr chan<- ProgressReport, partial bool) error {
+// Entries with Encrypt set are stored encrypted with password.
+func backupPlain(ctx context.Context, path string, recipe Recipe, password []byte, pr chan<- ProgressReport, partial bool, jobs int) error {
 	defer close(pr)
 
-	backupFolder := ""
-	backupTmp := ""
-	var err error
-	if partial {
-		backupFolder, err = filepath.Abs(filepath.Join(path, "dbkp"))
-		if err != nil {
-			return err
-		}
-
-		if err := os.MkdirAll(backupFolder, os.ModeDir|os.ModePerm); err != nil {
-			return err
-		}
-	} else {
-		backupTmp, err = filepath.Abs(filepath.Join(path, "dbkp-tmp"))
-		if err != nil {
-			return err
-		}
+	target, err := filepath.Abs(filepath.Join(path, "dbkp"))
+	if err != nil {
+		return err
+	}
 
-		if err := os.RemoveAll(backupTmp); err != nil {
-			return err
-		}
+	// Entries are backed up into backupFolder, and only replace the ones in
+	// target once every entry succeeded and passed the secret policy.
+	backupFolder, err := filepath.Abs(filepath.Join(path, "dbkp-tmp"))
+	if err != nil {
+		return err
+	}
 
-		if err := os.MkdirAll(backupTmp, os.ModeDir|os.ModePerm); err != nil {
-			return err
-		}
+	if err := os.RemoveAll(backupFolder); err != nil {
+		return err
+	}
 
-		backupFolder = backupTmp
+	if err := os.MkdirAll(backupFolder, os.ModeDir|os.ModePerm); err != nil {
+		return err
 	}
+	defer os.RemoveAll(backupFolder)
 
 	homePath, err := os.UserHomeDir()
 	if err != nil {
 		return err
 	}
 
-	stepsLen := uint64(len(recipe.Files) + len(recipe.Commands))
+	switch recipe.SecretPolicy {
+	case "", SecretPolicyWarn, SecretPolicyFail, SecretPolicyOff:
+	default:
+		return fmt.Errorf("unknown secret policy %q", recipe.SecretPolicy)
+	}
 
-	for i, file := range recipe.Files {
-		path := file.Path
-		if strings.HasPrefix(path, "~/") {
-			path = filepath.Join(homePath, path[2:])
+	// Guarded by secretsMutex, as entries are backed up concurrently.
+	var secretsMutex sync.Mutex
+	secrets := []SecretFinding{}
+	checkSecrets := func(count uint64, total uint64, name string, findings []SecretFinding) {
+		if len(findings) == 0 {
+			return
 		}
 
-		if pr != nil {
-			pr <- ProgressReport{uint64(i), stepsLen, file.Name}
-		}
+		secretsMutex.Lock()
+		secrets = append(secrets, findings...)
+		secretsMutex.Unlock()
 
-		backupPath := filepath.Join(backupFolder, file.Name)
-		if partial {
-			if err := os.RemoveAll(backupPath); err != nil {
-				return err
+		if pr != nil && recipe.SecretPolicy != SecretPolicyFail {
+			for _, finding := range findings {
+				pr <- ProgressReport{Count: count, Total: total, Name: name, Secret: &finding}
 			}
 		}
-		if err := copyFileOrFolder(path, backupPath, file); err != nil {
-			return err
-		}
 	}
 
-	shellPath, err := exec.LookPath("sh")
-	if err != nil {
-		return err
+	if recipe.hasEncryptedEntries() && password == nil {
+		return errors.New("the recipe has encrypted entries, but no password was given")
+	}
+
+	stepsLen := uint64(len(recipe.Files) + len(recipe.Commands) + len(recipe.Packages))
+	tracker := newProgressTracker(pr, stepsLen)
+	tasks := []task{}
+
+	// What each task stored, for the manifest.
+	records := make([]*ManifestEntry, stepsLen)
+
+	for i, file := range recipe.Files {
+		tracker.scan(file.Name, func() (uint64, error) {
+			return measureBackup(recipe, file)
+		})
+
+		tasks = append(tasks, task{name: file.Name, path: file.Path, phase: PhaseCopying, run: func(count uint64) error {
+			path := file.Path
+			if strings.HasPrefix(path, "~/") {
+				path = filepath.Join(homePath, path[2:])
+			}
+
+			scanner, err := newSecretScanner(file.Name, file.AllowSecrets)
+			if err != nil {
+				return err
+			}
+
+			filter, err := newBackupFilter(recipe, file)
+			if err != nil {
+				return err
+			}
+			filter = filter.reportingTo(file.Name, skipReporter(pr, count, stepsLen, file.Name))
+			filter = filter.countingTo(tracker.copied(count, file.Name)).cancelledBy(ctx)
+
+			record := &ManifestEntry{Name: file.Name, Kind: "file", Encrypted: file.Encrypt}
+			filter = filter.recordingTo(func(f ManifestFile) {
+				record.Files = append(record.Files, f)
+			})
+
+			backupPath := filepath.Join(backupFolder, file.Name)
+			if file.Encrypt {
+				data, err := tarFileOrFolder(file.Name, path, filter)
+				if err != nil {
+					return err
+				}
+
+				tracker.send(ProgressReport{Count: count, Name: file.Name, Phase: PhaseEncrypting})
+				if err := writeBlob(backupPath, password, data); err != nil {
+					return err
+				}
+
+				record.Created = time.Now()
+				records[i] = record
+				return nil
+			}
+
+			if err := copyFileOrFolder(path, backupPath, filter); err != nil {
+				return err
+			}
+
+			record.Created = time.Now()
+			records[i] = record
+
+			if recipe.SecretPolicy != SecretPolicyOff {
+				findings, err := scanner.scanPath(backupPath)
+				if err != nil && !errors.Is(err, fs.ErrNotExist) {
+					return err
+				}
+				checkSecrets(count, stepsLen, file.Name, findings)
+			}
+
+			return nil
+		}})
 	}
 
 	for i, command := range recipe.Commands {
-		if pr != nil {
-			pr <- ProgressReport{uint64(i + len(recipe.Files)), stepsLen, command.Name}
-		}
+		i := i + len(recipe.Files)
+		tasks = append(tasks, task{name: command.Name, serial: command.Serial, phase: PhaseRunning, run: func(count uint64) error {
+			scanner, err := newSecretScanner(command.Name, command.AllowSecrets)
+			if err != nil {
+				return err
+			}
 
-		var stdout bytes.Buffer
-		var stderr bytes.Buffer
-		backupPath := filepath.Join(backupFolder, command.Name)
+			var stdout bytes.Buffer
+			var stderr bytes.Buffer
+			backupPath := filepath.Join(backupFolder, command.Name)
+			stderrPath := backupPath + stderrSuffix
 
-		if err := executeCommandInShell(shellPath, command.Backup, nil, &stdout, &stderr); err != nil {
-			return errors.Join(err, fmt.Errorf("Command failed with error\n: %s", stderr.String()))
+			result, err := executeBackup(ctx, command, &stdout, &stderr)
+			reportResult(pr, count, stepsLen, result)
+
+			failure, err := command.checkFailure(err, &stderr)
+			if err != nil {
+				return err
+			}
+
+			if failure != nil {
+				reportFailure(pr, count, stepsLen, failure)
+				if command.OnFailure == OnFailureSkip {
+					records[i] = command.skippedRecord(result)
+					return nil
+				}
+			}
+
+			if recipe.SecretPolicy != SecretPolicyOff && !command.Encrypt {
+				findings := scanner.scan(command.Name, stdout.Bytes())
+				if command.SaveStderr {
+					findings = append(findings, scanner.scan(command.Name+stderrSuffix, stderr.Bytes())...)
+				}
+				checkSecrets(count, stepsLen, command.Name, findings)
+			}
+
+			record := &ManifestEntry{
+				Name:      command.Name,
+				Kind:      "command",
+				Created:   time.Now(),
+				Encrypted: command.Encrypt,
+				Output:    newOutputRecord(stdout.Bytes()),
+				ExitCode:  &result.ExitCode,
+			}
+
+			if err := writeOutput(backupPath, stdout.Bytes(), password, command.Encrypt); err != nil {
+				return err
+			}
+
+			if command.SaveStderr {
+				if err := writeOutput(stderrPath, stderr.Bytes(), password, command.Encrypt); err != nil {
+					return err
+				}
+				record.Stderr = newOutputRecord(stderr.Bytes())
+			}
+
+			records[i] = record
+			return nil
+		}})
+	}
+
+	for i, set := range recipe.Packages {
+		i := i + len(recipe.Files) + len(recipe.Commands)
+		tasks = append(tasks, task{name: set.Name, serial: set.Serial, phase: PhaseRunning, run: func(count uint64) error {
+			data, err := set.backup(ctx)
+			if err != nil {
+				return err
+			}
+
+			if err := os.WriteFile(filepath.Join(backupFolder, set.Name), data, 0666); err != nil {
+				return err
+			}
+
+			records[i] = &ManifestEntry{Name: set.Name, Kind: "packages", Created: time.Now(), Output: newOutputRecord(data)}
+			return nil
+		}})
+	}
+
+	if err := runTasks(ctx, tasks, jobs, tracker); err != nil {
+		return err
+	}
+
+	if recipe.SecretPolicy == SecretPolicyFail && len(secrets) > 0 {
+		return fmt.Errorf("possible secrets found, refusing to write an unencrypted backup:\n%s", formatSecretFindings(secrets))
+	}
+
+	var previous *Manifest
+	if partial {
+		if manifest, err := readManifest(target); err == nil {
+			previous = &manifest
 		}
+	}
+
+	manifest, err := buildManifest(previous, map[string]struct{}{}, records).encode()
+	if err != nil {
+		return err
+	}
 
-		f, err := os.Create(backupPath)
-		if err != nil {
+	if !partial {
+		if err := os.WriteFile(filepath.Join(backupFolder, manifestName), manifest, 0666); err != nil {
 			return err
 		}
-		defer func() {
-			if e := f.Close(); e != nil {
-				err = e
-			}
-		}()
 
-		if _, err := f.Write(stdout.Bytes()); err != nil {
+		if err := os.RemoveAll(target); err != nil {
 			return err
 		}
+
+		return os.Rename(backupFolder, target)
 	}
 
-	if !partial {
-		if err := os.RemoveAll(filepath.Join(path, "dbkp")); err != nil {
+	if err := os.MkdirAll(target, os.ModeDir|os.ModePerm); err != nil {
+		return err
+	}
+
+	// What is stored for the selected entries is replaced, including what
+	// they no longer store, like the stderr of a Command without SaveStderr.
+	for name := range recipe.storedNames(recipe.names()) {
+		if name == manifestName {
+			continue
+		}
+
+		if err := os.RemoveAll(filepath.Join(target, name)); err != nil {
 			return err
 		}
 
-		if err := os.Rename(backupFolder, filepath.Join(path, "dbkp")); err != nil {
+		err := os.Rename(filepath.Join(backupFolder, name), filepath.Join(target, name))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
 			return err
 		}
 	}
 
-	return nil
+	return os.WriteFile(filepath.Join(target, manifestName), manifest, 0666)
 }
 
 // Executes an encrypted backup of recipe. A password is expected to be given
 // (i.e.: non-nil/non-empty).
-func backupEncrypted(path string, recipe Recipe, selected Recipe, password []byte, pr chan<- ProgressReport, partial bool) error {
+func backupEncrypted(ctx context.Context, path string, recipePath string, recipe Recipe, selected Recipe, password []byte, pr chan<- ProgressReport, partial bool, jobs int) error {
 	defer close(pr)
 
 	backupFile, err := filepath.Abs(filepath.Join(path, "dbkp"))
@@ -152,7 +317,7 @@ func backupEncrypted(path string, recipe Recipe, selected Recipe, password []byt
 
 	var existing Tarball
 	if partial {
-		if _, err := os.Stat(backupFile); err == nil && len(recipe.EncryptionSalt) > 0 && len(recipe.EncryptionSalt[0]) > 0 {
+		if info, err := os.Stat(backupFile); err == nil && info.Mode().IsRegular() && recipe.Encrypted() {
 			existing, err = loadTarball(backupFile, password, recipe)
 			if err != nil {
 				return err
@@ -179,67 +344,229 @@ func backupEncrypted(path string, recipe Recipe, selected Recipe, password []byt
 
 	for _, command := range selected.Commands {
 		selectedNames[command.Name] = struct{}{}
+		selectedNames[command.Name+stderrSuffix] = struct{}{}
+	}
+
+	for _, set := range selected.Packages {
+		selectedNames[set.Name] = struct{}{}
 	}
 
+	// The manifest of the existing backup is updated, not copied.
+	var previous *Manifest
+	if partial && existing.Buffer.Len() > 0 {
+		if data, err := existing.readFile(manifestName); err == nil {
+			if manifest, err := parseManifest(data.Bytes()); err == nil {
+				previous = &manifest
+			}
+		}
+	}
+	selectedNames[manifestName] = struct{}{}
+
 	if partial && existing.Buffer.Len() > 0 {
 		if err := existing.copyEntriesExcluding(&tarball, selectedNames); err != nil {
 			return err
 		}
 	}
 
-	stepsLen := uint64(len(selected.Files) + len(selected.Commands))
+	stepsLen := uint64(len(selected.Files) + len(selected.Commands) + len(selected.Packages))
+	tracker := newProgressTracker(pr, stepsLen)
+	tasks := []task{}
+
+	// Members of the tarball produced by each task, added in the order of the
+	// recipe once every task finished, so the tarball does not depend on which
+	// task finished first.
+	members := make([][]tarMember, stepsLen)
+	records := make([]*ManifestEntry, stepsLen)
 
 	for i, file := range selected.Files {
-		path := file.Path
-		if strings.HasPrefix(path, "~/") {
-			path = filepath.Join(homePath, path[2:])
-		}
+		tracker.scan(file.Name, func() (uint64, error) {
+			return measureBackup(recipe, file)
+		})
+
+		tasks = append(tasks, task{name: file.Name, path: file.Path, phase: PhaseCopying, run: func(count uint64) error {
+			path := file.Path
+			if strings.HasPrefix(path, "~/") {
+				path = filepath.Join(homePath, path[2:])
+			}
 
-		if pr != nil {
-			pr <- ProgressReport{uint64(i + 1), stepsLen, file.Name}
-		}
+			filter, err := newBackupFilter(recipe, file)
+			if err != nil {
+				return err
+			}
+			filter = filter.reportingTo(file.Name, skipReporter(pr, count, stepsLen, file.Name))
+			filter = filter.countingTo(tracker.copied(count, file.Name)).cancelledBy(ctx)
 
-		subtarball := Tarball{}
-		subtarball.makeWrite()
+			record := &ManifestEntry{Name: file.Name, Kind: "file"}
+			filter = filter.recordingTo(func(f ManifestFile) {
+				record.Files = append(record.Files, f)
+			})
 
-		if err := subtarball.addFileOrFolder(file.Name, path, file); err != nil {
-			return err
-		}
+			data, err := tarFileOrFolder(file.Name, path, filter)
+			if err != nil {
+				return err
+			}
 
-		if err := subtarball.closeWrite(); err != nil {
-			return err
-		}
+			record.Created = time.Now()
+			members[i] = []tarMember{{file.Name, data}}
+			records[i] = record
+			return nil
+		}})
+	}
 
-		if err := tarball.addFile(file.Name, subtarball.Buffer.Bytes()); err != nil {
-			return err
-		}
+	for i, command := range selected.Commands {
+		i := i + len(selected.Files)
+		tasks = append(tasks, task{name: command.Name, serial: command.Serial, phase: PhaseRunning, run: func(count uint64) error {
+			var stdout bytes.Buffer
+			var stderr bytes.Buffer
+
+			result, err := executeBackup(ctx, command, &stdout, &stderr)
+			reportResult(pr, count, stepsLen, result)
+
+			failure, err := command.checkFailure(err, &stderr)
+			if err != nil {
+				return err
+			}
+
+			if failure != nil {
+				reportFailure(pr, count, stepsLen, failure)
+				if command.OnFailure == OnFailureSkip {
+					records[i] = command.skippedRecord(result)
+					return nil
+				}
+			}
+
+			members[i] = []tarMember{{command.Name, stdout.Bytes()}}
+			records[i] = &ManifestEntry{
+				Name:     command.Name,
+				Kind:     "command",
+				Created:  time.Now(),
+				Output:   newOutputRecord(stdout.Bytes()),
+				ExitCode: &result.ExitCode,
+			}
+
+			if command.SaveStderr {
+				members[i] = append(members[i], tarMember{command.Name + stderrSuffix, stderr.Bytes()})
+				records[i].Stderr = newOutputRecord(stderr.Bytes())
+			}
+
+			return nil
+		}})
 	}
 
-	shellPath, err := exec.LookPath("sh")
-	if err != nil {
+	for i, set := range selected.Packages {
+		i := i + len(selected.Files) + len(selected.Commands)
+		tasks = append(tasks, task{name: set.Name, serial: set.Serial, phase: PhaseRunning, run: func(count uint64) error {
+			data, err := set.backup(ctx)
+			if err != nil {
+				return err
+			}
+
+			members[i] = []tarMember{{set.Name, data}}
+			records[i] = &ManifestEntry{Name: set.Name, Kind: "packages", Created: time.Now(), Output: newOutputRecord(data)}
+			return nil
+		}})
+	}
+
+	if err := runTasks(ctx, tasks, jobs, tracker); err != nil {
 		return err
 	}
 
-	for i, command := range selected.Commands {
-		if pr != nil {
-			pr <- ProgressReport{uint64(i + len(selected.Files) + 1), stepsLen, command.Name}
+	for _, entry := range members {
+		for _, member := range entry {
+			if err := tarball.addFile(member.name, member.data); err != nil {
+				return err
+			}
 		}
+	}
 
-		var stdout bytes.Buffer
-		var stderr bytes.Buffer
-
-		if err := executeCommandInShell(shellPath, command.Backup, nil, &stdout, &stderr); err != nil {
-			return errors.Join(err, fmt.Errorf("Command failed with error\n: %s", stderr.String()))
-		}
+	manifest, err := buildManifest(previous, selectedNames, records).encode()
+	if err != nil {
+		return err
+	}
 
-		if err := tarball.addFile(command.Name, stdout.Bytes()); err != nil {
-			return err
-		}
+	if err := tarball.addFile(manifestName, manifest); err != nil {
+		return err
 	}
 
-	if err := tarball.writeToFile(backupFile, password, recipe); err != nil {
+	tracker.send(ProgressReport{Count: stepsLen, Phase: PhaseEncrypting})
+	if err := tarball.writeToFile(backupFile, recipePath, password, recipe); err != nil {
 		return err
 	}
 
 	return nil
 }
+
+// Creates the manifest record of command, whose Backup failed with result
+// and was skipped.
+func (command Command) skippedRecord(result *CommandResult) *ManifestEntry {
+	return &ManifestEntry{
+		Name:     command.Name,
+		Kind:     "command",
+		Created:  time.Now(),
+		ExitCode: &result.ExitCode,
+		Skipped:  true,
+	}
+}
+
+// A file to be added to a tarball.
+type tarMember struct {
+	name string
+	data []byte
+}
+
+// Creates the filter used to back up file, enforcing its SkipRules on top of
+// the ones of the recipe.
+func newBackupFilter(recipe Recipe, file File) (pathFilter, error) {
+	filter, err := newPathFilter(file)
+	if err != nil {
+		return filter, err
+	}
+
+	filter, err = filter.withLimits(file.SkipRules.inherit(recipe.SkipRules))
+	if err != nil {
+		return filter, fmt.Errorf("%s: %w", file.Name, err)
+	}
+
+	return filter, nil
+}
+
+// Measures the bytes of file that a backup of recipe would copy.
+func measureBackup(recipe Recipe, file File) (uint64, error) {
+	filter, err := newBackupFilter(recipe, file)
+	if err != nil {
+		return 0, err
+	}
+
+	path, err := expandHome(file.Path)
+	if err != nil {
+		return 0, err
+	}
+
+	return measureFileOrFolder(path, filter)
+}
+
+// Creates a tarball with the file/folder in path stored as name, respecting
+// filter, and returns its contents.
+func tarFileOrFolder(name string, path string, filter pathFilter) ([]byte, error) {
+	tarball := Tarball{}
+	tarball.makeWrite()
+
+	if err := tarball.addFileOrFolder(name, path, filter); err != nil {
+		return nil, err
+	}
+
+	if err := tarball.closeWrite(); err != nil {
+		return nil, err
+	}
+
+	return tarball.Buffer.Bytes(), nil
+}
+
+// Writes data to path, encrypted with password if encrypt is set.
+func writeOutput(path string, data []byte, password []byte, encrypt bool) error {
+	if encrypt {
+		return writeBlob(path, password, data)
+	}
+
+	return os.WriteFile(path, data, 0666)
+}
@@ -0,0 +1,74 @@
+package dbkp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"os"
+)
+
+// Header of the files holding encrypted entries of plain backups. It is
+// followed by the 32 bytes of key salt, the 12 bytes of IV and the ciphertext.
+var blobMagic = []byte("DBKPENC1")
+
+// Encrypts data with a key derived from password, returning a blob that holds
+// everything needed to decrypt it again but the password.
+func encryptBlob(password []byte, data []byte) ([]byte, error) {
+	key, keysalt := DeriveKeyFromPassword(password, "")
+	ciphertext, iv, err := Encrypt(key, data)
+	if err != nil {
+		return nil, err
+	}
+
+	saltbytes, err := hex.DecodeString(keysalt)
+	if err != nil {
+		return nil, err
+	}
+
+	ivbytes, err := hex.DecodeString(iv)
+	if err != nil {
+		return nil, err
+	}
+
+	var blob bytes.Buffer
+	blob.Write(blobMagic)
+	blob.Write(saltbytes)
+	blob.Write(ivbytes)
+	blob.Write(ciphertext)
+
+	return blob.Bytes(), nil
+}
+
+// Decrypts a blob created by encryptBlob.
+func decryptBlob(password []byte, blob []byte) ([]byte, error) {
+	header := len(blobMagic) + 32 + 12
+	if len(blob) < header || !bytes.Equal(blob[:len(blobMagic)], blobMagic) {
+		return nil, corruptArchive(errors.New("not an encrypted entry"))
+	}
+
+	keysalt := hex.EncodeToString(blob[len(blobMagic) : len(blobMagic)+32])
+	iv := hex.EncodeToString(blob[len(blobMagic)+32 : header])
+
+	key, _ := DeriveKeyFromPassword(password, keysalt)
+	return Decrypt(key, iv, blob[header:])
+}
+
+// Encrypts data and writes it to path.
+func writeBlob(path string, password []byte, data []byte) error {
+	blob, err := encryptBlob(password, data)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, blob, 0600)
+}
+
+// Reads the blob in path and decrypts it.
+func readBlob(path string, password []byte) ([]byte, error) {
+	blob, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return decryptBlob(password, blob)
+}
@@ -0,0 +1,350 @@
+package dbkp
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// The start of a key or table header in a recipe file.
+type keyPosition struct {
+	line   int
+	column int
+}
+
+// Matches a line defining a bare key.
+var keyLinePattern = regexp.MustCompile(`^\s*([A-Za-z0-9_-]+)\s*=`)
+
+// Finds where the tables and keys of the TOML document data are. Tables are
+// named by their header, with the index of the element for arrays of tables
+// (e.g.: "Files.2"), and keys by their table and name (e.g.: "Files.2.Name").
+// Top level keys have no table. Only headers and bare keys at the start of a
+// line are found, which covers the recipes written by dbkp and most written
+// by hand.
+func locateKeys(data string) map[string]keyPosition {
+	positions := map[string]keyPosition{}
+	counts := map[string]int{}
+	table := ""
+
+	for i, line := range strings.Split(data, "\n") {
+		trimmed := strings.TrimSpace(line)
+		column := len(line) - len(strings.TrimLeft(line, " \t")) + 1
+
+		if header, ok := strings.CutPrefix(trimmed, "[["); ok {
+			header, _, _ = strings.Cut(header, "]]")
+			header = strings.TrimSpace(header)
+			table = fmt.Sprintf("%s.%d", header, counts[header])
+			counts[header]++
+			positions[table] = keyPosition{i + 1, column}
+		} else if header, ok := strings.CutPrefix(trimmed, "["); ok {
+			header, _, _ = strings.Cut(header, "]")
+			table = strings.TrimSpace(header)
+			positions[table] = keyPosition{i + 1, column}
+		} else if match := keyLinePattern.FindStringSubmatchIndex(line); match != nil {
+			key := line[match[2]:match[3]]
+			if table != "" {
+				key = table + "." + key
+			}
+			positions[key] = keyPosition{i + 1, match[2] + 1}
+		}
+	}
+
+	return positions
+}
+
+// Reports whether path is parent or inside it.
+func within(path string, parent string) bool {
+	rel, err := filepath.Rel(parent, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// Checks the recipe in the file path, merged with the files it includes,
+// without running anything, returning every problem found: unknown keys,
+// invalid or colliding names (also when they only differ in case), settings
+// that do not parse, missing source paths, entries whose paths overlap and
+// paths containing the backup folder. Problems are found in the file setting
+// the key last and are sorted by file, in the order they are merged, and
+// position. If a file cannot be decoded, only why is reported. Returns an
+// error if the file in path cannot be read.
+func CheckRecipe(path string) ([]RecipeProblem, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := os.ReadFile(path); err != nil {
+		return nil, err
+	}
+
+	layered, err := resolveLayers(path)
+	var layerErr *layerError
+	if errors.As(err, &layerErr) {
+		return layerProblems(layerErr), nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	positions := make([]map[string]keyPosition, len(layered.layers))
+	order := map[string]int{}
+	for i, layer := range layered.layers {
+		data, err := os.ReadFile(layer.path)
+		if err != nil {
+			return nil, err
+		}
+		positions[i] = locateKeys(string(data))
+		order[layer.path] = i
+	}
+
+	main := len(layered.layers) - 1
+	problems := []RecipeProblem{}
+
+	// Adds problem, found in table of the layer, at the position of its key,
+	// or of the table if the key is not found.
+	add := func(layer int, table string, problem RecipeProblem) {
+		key := problem.Key
+		if table != "" {
+			key = table + "." + key
+		}
+
+		position, ok := positions[layer][key]
+		if !ok {
+			position = positions[layer][table]
+		}
+
+		problem.File = layered.layers[layer].path
+		problem.Line = position.line
+		problem.Column = position.column
+		problems = append(problems, problem)
+	}
+
+	// Adds problem of the merged entry at index of section, in the layer
+	// setting its key last.
+	addEntry := func(section string, index int, problem RecipeProblem) {
+		layer, i := layered.entryLayer(section, index, problem.Key)
+		add(layer, fmt.Sprintf("%s.%d", section, i), problem)
+	}
+
+	// The merged entries, in order, to find them by position.
+	type entry struct {
+		section     string
+		index       int
+		name        string
+		destination string
+	}
+	entries := []entry{}
+
+	recipe := layered.recipe
+	for i, file := range recipe.Files {
+		entries = append(entries, entry{"Files", i, file.Name, file.Destination})
+		for _, problem := range file.problems() {
+			addEntry("Files", i, problem)
+		}
+	}
+
+	for i, command := range recipe.Commands {
+		entries = append(entries, entry{"Commands", i, command.Name, command.Destination})
+		for _, problem := range command.problems() {
+			addEntry("Commands", i, problem)
+		}
+	}
+
+	for i, set := range recipe.Packages {
+		entries = append(entries, entry{"Packages", i, set.Name, set.Destination})
+		for _, problem := range set.problems() {
+			addEntry("Packages", i, problem)
+		}
+	}
+
+	for i, layer := range layered.layers {
+		for _, key := range layer.meta.Undecoded() {
+			err := fmt.Errorf("unknown key %s", key[len(key)-1])
+			section := fieldName(reflect.TypeOf(Recipe{}), key[0])
+			if len(key) != 2 || !slices.Contains(recipeSections, section) {
+				add(i, "", RecipeProblem{Key: key.String(), Err: err})
+				continue
+			}
+
+			values := layer.section(section)
+			for j := range values.Len() {
+				table := fmt.Sprintf("%s.%d", key[0], j)
+				if _, ok := positions[i][table+"."+key[1]]; ok {
+					name := values.Index(j).FieldByName("Name").String()
+					add(i, table, RecipeProblem{Entry: name, Key: key[1], Err: err})
+				}
+			}
+		}
+	}
+
+	switch recipe.SecretPolicy {
+	case "", SecretPolicyWarn, SecretPolicyFail, SecretPolicyOff:
+	default:
+		layer, ok := layered.keys["SecretPolicy"]
+		if !ok {
+			layer = main
+		}
+		add(layer, "", RecipeProblem{Key: "SecretPolicy", Err: fmt.Errorf("unknown secret policy %q", recipe.SecretPolicy)})
+	}
+
+	if _, err := newFileLimits(recipe.SkipRules); err != nil {
+		add(main, "", RecipeProblem{Err: err})
+	}
+
+	names := map[string]struct{}{}
+	folded := map[string]string{}
+	for _, entry := range entries {
+		if entry.name == "" {
+			continue
+		}
+
+		if _, ok := names[entry.name]; ok {
+			addEntry(entry.section, entry.index, RecipeProblem{Entry: entry.name, Key: "Name", Err: fmt.Errorf("the Name %q is used by another entry", entry.name)})
+		} else if other, ok := folded[strings.ToLower(entry.name)]; ok {
+			addEntry(entry.section, entry.index, RecipeProblem{Entry: entry.name, Key: "Name", Err: fmt.Errorf("the Name %q only differs in case from %q", entry.name, other)})
+		}
+
+		names[entry.name] = struct{}{}
+		folded[strings.ToLower(entry.name)] = entry.name
+	}
+
+	dir := filepath.Dir(path)
+	destination, _ := recipe.destinationPath(dir, "")
+	backupFolders := []string{filepath.Join(destination, "dbkp")}
+
+	for _, entry := range entries {
+		if entry.destination == "" {
+			continue
+		}
+
+		folder, err := recipe.destinationPath(dir, entry.destination)
+		if err != nil {
+			addEntry(entry.section, entry.index, RecipeProblem{Entry: entry.name, Key: "Destination", Err: err})
+			continue
+		}
+
+		if recipe.Encrypted() && folder != destination {
+			addEntry(entry.section, entry.index, RecipeProblem{Entry: entry.name, Key: "Destination", Err: errors.New("encrypted backups do not support a Destination per entry")})
+		} else if !slices.Contains(backupFolders, filepath.Join(folder, "dbkp")) {
+			backupFolders = append(backupFolders, filepath.Join(folder, "dbkp"))
+		}
+	}
+
+	paths := make([]string, len(recipe.Files))
+	for i, file := range recipe.Files {
+		if expanded, err := expandHome(file.Path); err == nil && file.Path != "" {
+			paths[i], _ = filepath.Abs(expanded)
+		}
+	}
+
+	for i, file := range recipe.Files {
+		if paths[i] == "" {
+			continue
+		}
+
+		for j, other := range recipe.Files {
+			if i == j || paths[j] == "" || !within(paths[i], paths[j]) {
+				continue
+			}
+
+			if paths[i] != paths[j] {
+				addEntry("Files", i, RecipeProblem{Entry: file.Name, Key: "Path", Err: fmt.Errorf("the Path is inside the Path of %q", other.Name)})
+			} else if i > j {
+				addEntry("Files", i, RecipeProblem{Entry: file.Name, Key: "Path", Err: fmt.Errorf("the Path is the same as the Path of %q", other.Name)})
+			}
+		}
+
+		for _, backupFolder := range backupFolders {
+			if within(backupFolder, paths[i]) {
+				addEntry("Files", i, RecipeProblem{Entry: file.Name, Key: "Path", Err: fmt.Errorf("the backup folder %s is inside the Path", backupFolder)})
+			}
+		}
+	}
+
+	slices.SortStableFunc(problems, func(a, b RecipeProblem) int {
+		if a.File != b.File {
+			return order[a.File] - order[b.File]
+		}
+		if a.Line != b.Line {
+			return a.Line - b.Line
+		}
+		return a.Column - b.Column
+	})
+
+	return problems, nil
+}
+
+// Returns why the recipe file of err could not be loaded as problems: the
+// Symlinks that are not pairs, if any, or err itself.
+func layerProblems(err *layerError) []RecipeProblem {
+	problems := []RecipeProblem{}
+
+	data, readErr := os.ReadFile(err.path)
+	raw := map[string]any{}
+	if readErr == nil {
+		if _, decodeErr := toml.Decode(string(data), &raw); decodeErr == nil {
+			problems = symlinkPairProblems(raw, locateKeys(string(data)))
+		}
+	}
+
+	// Symlinks that are not pairs cannot be decoded into the recipe.
+	if len(problems) == 0 {
+		problems = syntaxProblems(err.err)
+	}
+
+	for i := range problems {
+		problems[i].File = err.path
+	}
+
+	return problems
+}
+
+// Returns err, from decoding a recipe, as the only problem, at its position
+// if it is known.
+func syntaxProblems(err error) []RecipeProblem {
+	var parseErr toml.ParseError
+	if errors.As(err, &parseErr) {
+		return []RecipeProblem{{
+			Key:    parseErr.LastKey,
+			Line:   parseErr.Position.Line,
+			Column: parseErr.Position.Col,
+			Err:    errors.New(parseErr.Message),
+		}}
+	}
+
+	return []RecipeProblem{{Err: err}}
+}
+
+// Finds the Symlinks of the Files in the decoded TOML document raw that are
+// not pairs of strings.
+func symlinkPairProblems(raw map[string]any, positions map[string]keyPosition) []RecipeProblem {
+	problems := []RecipeProblem{}
+
+	files, _ := raw["Files"].([]map[string]any)
+	for i, file := range files {
+		symlinks, _ := file["Symlinks"].([]any)
+		for _, symlink := range symlinks {
+			pair, _ := symlink.([]any)
+			if len(pair) == 2 {
+				continue
+			}
+
+			name, _ := file["Name"].(string)
+			position := positions[fmt.Sprintf("Files.%d.Symlinks", i)]
+			problems = append(problems, RecipeProblem{
+				Entry:  name,
+				Key:    "Symlinks",
+				Line:   position.line,
+				Column: position.column,
+				Err:    fmt.Errorf("invalid symlink %v, expected a pair of paths", symlink),
+			})
+		}
+	}
+
+	return problems
+}
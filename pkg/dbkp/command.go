@@ -0,0 +1,332 @@
+package dbkp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Value of Command.Shell that runs the scripts directly, splitting them into
+// arguments with the usual quoting rules, instead of passing them to a shell.
+const ShellNone = "none"
+
+// Values accepted in Command.OnFailure.
+const (
+	OnFailureAbort = "abort" // Stops the backup/restore with an error. The default.
+	OnFailureWarn  = "warn"  // Reports the failure and keeps the output as if the command succeeded.
+	OnFailureSkip  = "skip"  // Reports the failure and does not save the output.
+)
+
+// Suffix of the file, next to the output of a Command, holding its stderr when
+// SaveStderr is set.
+const stderrSuffix = ".stderr"
+
+// A Command that failed, but whose OnFailure policy allowed the backup/restore
+// to go on.
+type CommandFailure struct {
+	Entry    string // The Name of the Command or PackageSet.
+	Package  string // For a PackageSet, the package that could not be installed or removed.
+	ExitCode int    // The exit code, or -1 if the command did not exit by itself (e.g.: timeout).
+	Error    string // The error message.
+	Stderr   string // What the command wrote to stderr.
+}
+
+// The outcome of running a script of a Command.
+type CommandResult struct {
+	Entry    string        // The Name of the Command.
+	Script   string        // Which script ran: "backup", "restore" or "check".
+	ExitCode int           // The exit code, or -1 if the command did not exit by itself (e.g.: timeout).
+	Duration time.Duration // How long the script ran.
+}
+
+// Time given to a killed command to release its stdout/stderr before giving up
+// on them.
+const commandWaitDelay = 5 * time.Second
+
+// Executes the Backup script of command, writing its output to stdout and
+// stderr.
+func executeBackup(ctx context.Context, command Command, stdout *bytes.Buffer, stderr *bytes.Buffer) (*CommandResult, error) {
+	start := time.Now()
+	err := executeCommand(ctx, command, command.Backup, command.backupTimeout(), nil, stdout, stderr)
+	return command.result("backup", start, err), err
+}
+
+// Executes the Check script of command, writing its output to stdout.
+func executeCheck(ctx context.Context, command Command, stdout *bytes.Buffer) error {
+	return executeCommand(ctx, command, command.Check, command.restoreTimeout(), nil, stdout, nil)
+}
+
+// Executes the Restore script of command, feeding stdin to it.
+func executeRestore(ctx context.Context, command Command, stdin *bytes.Buffer, stderr *bytes.Buffer) (*CommandResult, error) {
+	start := time.Now()
+	err := executeCommand(ctx, command, command.Restore, command.restoreTimeout(), stdin, nil, stderr)
+	return command.result("restore", start, err), err
+}
+
+// Returns the result of the script of command that started at start and
+// finished with err.
+func (command Command) result(script string, start time.Time, err error) *CommandResult {
+	code := 0
+	if err != nil {
+		code = exitCode(err)
+	}
+
+	return &CommandResult{Entry: command.Name, Script: script, ExitCode: code, Duration: time.Since(start)}
+}
+
+func (command Command) backupTimeout() string {
+	if command.BackupTimeout != "" {
+		return command.BackupTimeout
+	}
+	return command.Timeout
+}
+
+func (command Command) restoreTimeout() string {
+	if command.RestoreTimeout != "" {
+		return command.RestoreTimeout
+	}
+	return command.Timeout
+}
+
+// Executes script with the shell, working directory and environment of
+// command. If timeout is not empty and the script runs for longer than it, or
+// if ctx is cancelled, the script and every process it started are killed.
+func executeCommand(ctx context.Context, command Command, script string, timeout string, stdin *bytes.Buffer, stdout *bytes.Buffer, stderr *bytes.Buffer) error {
+	switch command.OnFailure {
+	case "", OnFailureAbort, OnFailureWarn, OnFailureSkip:
+	default:
+		return fmt.Errorf("unknown OnFailure %q", command.OnFailure)
+	}
+
+	args, err := command.argv(script)
+	if err != nil {
+		return err
+	}
+
+	runCtx := ctx
+	if timeout != "" {
+		duration, err := time.ParseDuration(timeout)
+		if err != nil {
+			return fmt.Errorf("invalid timeout %q: %w", timeout, err)
+		}
+
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, duration)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(runCtx, args[0], args[1:]...)
+	cmd.WaitDelay = commandWaitDelay
+	setProcessGroup(cmd, timeout != "")
+
+	if command.Dir != "" {
+		dir, err := expandHome(command.Dir)
+		if err != nil {
+			return err
+		}
+		cmd.Dir = dir
+	}
+
+	if len(command.Env) > 0 {
+		cmd.Env = os.Environ()
+		for _, key := range slices.Sorted(maps.Keys(command.Env)) {
+			cmd.Env = append(cmd.Env, key+"="+command.Env[key])
+		}
+	}
+
+	if stdin != nil {
+		cmd.Stdin = stdin
+	}
+
+	if stdout != nil {
+		cmd.Stdout = stdout
+	}
+
+	if stderr != nil {
+		cmd.Stderr = stderr
+	}
+
+	err = cmd.Run()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	} else if errors.Is(runCtx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("timed out after %s", timeout)
+	}
+
+	return err
+}
+
+// Decides what to do after a script of command finished with err. Exit codes
+// in AllowedExitCodes are not failures. Returns the error to abort with, or the
+// failure to report if OnFailure lets the run go on.
+func (command Command) checkFailure(err error, stderr *bytes.Buffer) (*CommandFailure, error) {
+	if err == nil {
+		return nil, nil
+	} else if errors.Is(err, context.Canceled) {
+		return nil, err
+	}
+
+	exitCode := exitCode(err)
+	if exitCode > 0 && slices.Contains(command.AllowedExitCodes, exitCode) {
+		return nil, nil
+	}
+
+	if command.OnFailure != OnFailureWarn && command.OnFailure != OnFailureSkip {
+		return nil, &CommandError{Entry: command.Name, ExitCode: exitCode, Stderr: stderr.String(), Err: err}
+	}
+
+	return &CommandFailure{
+		Entry:    command.Name,
+		ExitCode: exitCode,
+		Error:    err.Error(),
+		Stderr:   stderr.String(),
+	}, nil
+}
+
+// Returns the exit code of the command that failed with err, or -1 if it did
+// not exit by itself.
+func exitCode(err error) int {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
+// Runs Check to find out which lines of the saved output data are not present
+// in the current state. If Check succeeds without output, or every line is
+// already present, returns true. If Check fails, its output cannot be trusted:
+// the whole of data is pending and the error is returned with it.
+func (command Command) pendingInput(ctx context.Context, data []byte) ([]byte, bool, error) {
+	var stdout bytes.Buffer
+	if err := executeCheck(ctx, command, &stdout); err != nil {
+		if ctx.Err() != nil {
+			return nil, false, ctx.Err()
+		}
+		return data, false, err
+	}
+
+	current := map[string]struct{}{}
+	for line := range strings.SplitSeq(stdout.String(), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			current[line] = struct{}{}
+		}
+	}
+
+	if len(current) == 0 {
+		return nil, true, nil
+	}
+
+	var pending bytes.Buffer
+	for line := range strings.SplitSeq(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if _, ok := current[line]; ok || line == "" {
+			continue
+		}
+
+		current[line] = struct{}{}
+		pending.WriteString(line)
+		pending.WriteString("\n")
+	}
+
+	return pending.Bytes(), pending.Len() == 0, nil
+}
+
+// Returns the arguments used to run script according to Shell.
+func (command Command) argv(script string) ([]string, error) {
+	switch command.Shell {
+	case "":
+		return []string{"sh", "-c", script}, nil
+	case ShellNone:
+		args, err := splitArgs(script)
+		if err != nil {
+			return nil, err
+		}
+		if len(args) == 0 {
+			return nil, errors.New("empty command")
+		}
+		return args, nil
+	default:
+		return []string{command.Shell, "-c", script}, nil
+	}
+}
+
+// Splits a command line into arguments, honouring single quotes, double quotes
+// and backslash escapes like a POSIX shell would (without expansions).
+func splitArgs(line string) ([]string, error) {
+	args := []string{}
+	var current strings.Builder
+	inArg := false
+	var quote rune
+
+	runes := []rune(line)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+
+		switch {
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case r == '\\' && quote != '\'':
+			if i+1 == len(runes) {
+				return nil, errors.New("trailing backslash")
+			}
+			i++
+			current.WriteRune(runes[i])
+			inArg = true
+		case quote == '"':
+			if r == '"' {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inArg = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	}
+
+	if inArg {
+		args = append(args, current.String())
+	}
+
+	return args, nil
+}
+
+// Replaces a leading ~/ in path with the home folder.
+func expandHome(path string) (string, error) {
+	if !strings.HasPrefix(path, "~/") {
+		return path, nil
+	}
+
+	homePath, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(homePath, path[2:]), nil
+}
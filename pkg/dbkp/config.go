@@ -8,56 +8,158 @@
 package dbkp
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"os"
 
 	"github.com/BurntSushi/toml"
 )
 
-// Represents a File or Folder backup.
+// Syntaxes accepted in File.ExcludeSyntax.
+const (
+	ExcludeSyntaxRegexp    = "regexp"    // Exclude holds Go regexps matched against the relative path (using `/`).
+	ExcludeSyntaxGitignore = "gitignore" // Exclude holds .gitignore-style patterns.
+)
+
+// Represents a File or Folder backup. Folders may contain .dbkpignore files,
+// with .gitignore syntax, which are honoured hierarchically as git does.
 type File struct {
-	Name     string      // Uniquely represents this File and is also the name of the file/folder inside the backup folder.
-	Path     string      // The path to the file/folder to be backed up in the filesystem.
-	Only     []string    // If Path is a folder, only backs up the items in Only, skipping all others.
-	Exclude  []string    // Regex patterns matched against the relative path (using `/`) that should be excluded.
-	Symlinks [][2]string // After restoring, creates symlinks from /path/to/backup/Name/Symlinks[][0] into Symlinks[][1].
+	Name          string      // Uniquely represents this File and is also the name of the file/folder inside the backup folder.
+	Path          string      // The path to the file/folder to be backed up in the filesystem.
+	Only          []string    // If Path is a folder, only backs up the relative paths or globs (with `**` support) in Only, skipping all others.
+	Exclude       []string    // Patterns matched against the relative path (using `/`) that should be excluded.
+	ExcludeSyntax string      `toml:",omitempty"` // Syntax of Exclude: ExcludeSyntaxRegexp (the default) or ExcludeSyntaxGitignore.
+	Symlinks      [][2]string // After restoring, creates symlinks from /path/to/backup/Name/Symlinks[][0] into Symlinks[][1].
+	SkipRules                 // Size, age and type limits for files inside Path. Unset rules are taken from the Recipe.
+	AllowSecrets  []string    `toml:",omitempty"` // Relative paths (globs) allowed to contain secrets, or "rule:NAME" to disable a detector for this File.
+	Encrypt       bool        `toml:",omitempty"` // Stores this File encrypted even if the backup is not.
+	Destination   string      `toml:",omitempty"` // Overrides Recipe.Destination for this File. Not supported by encrypted backups.
 }
 
 // Represents a pair of Backup and Restore commands.
 // Backup and Restore are strings because they will both be executed as
-// `sh -c 'CMD'`. The output of Backup is saved to a file
-// /path/to/backup/Name, which is read into the input of Restore when
+// `sh -c 'CMD'` (or with the shell in Shell). The output of Backup is saved to
+// a file /path/to/backup/Name, which is read into the input of Restore when
 // restoring.
 type Command struct {
-	Name    string // Uniquely represents this File and is also the name of the file/folder inside the backup folder.
-	Backup  string // The backup command to execute.
-	Restore string // The restore command to execute.
+	Name           string            // Uniquely represents this File and is also the name of the file/folder inside the backup folder.
+	Backup         string            // The backup command to execute.
+	Restore        string            // The restore command to execute.
+	Check          string            `toml:",omitempty"` // Prints the current state before restoring: Restore is skipped if it succeeds without output, and otherwise only gets the saved lines missing from its output, or all of them if it fails.
+	AllowSecrets   []string          `toml:",omitempty"` // Set to ["*"] to allow the output to contain secrets, or "rule:NAME" to disable a detector.
+	Encrypt        bool              `toml:",omitempty"` // Stores the output encrypted even if the backup is not.
+	Shell          string            `toml:",omitempty"` // The shell running Backup and Restore with -c, sh by default. ShellNone runs them directly.
+	Dir            string            `toml:",omitempty"` // The working directory of the commands.
+	Env            map[string]string `toml:",omitempty"` // Variables added to the inherited environment.
+	Timeout        string            `toml:",omitempty"` // Maximum duration of each command, e.g.: "5m". The command and its children are killed after it.
+	BackupTimeout  string            `toml:",omitempty"` // Overrides Timeout for Backup.
+	RestoreTimeout string            `toml:",omitempty"` // Overrides Timeout for Restore.
+
+	AllowedExitCodes []int  `toml:",omitempty"` // Non-zero exit codes that are not failures.
+	OnFailure        string `toml:",omitempty"` // What to do when a command fails: OnFailureAbort (the default), OnFailureWarn or OnFailureSkip.
+	SaveStderr       bool   `toml:",omitempty"` // Saves the stderr of Backup to a Name.stderr file next to the output.
+	Serial           bool   `toml:",omitempty"` // Runs alone and in order: after every entry before it and before every entry after it.
+	Parallel         bool   `toml:",omitempty"` // Restores at the same time as other Commands and PackageSets, which are restored one at a time otherwise.
+	Destination      string `toml:",omitempty"` // Overrides Recipe.Destination for this Command. Not supported by encrypted backups.
+}
+
+// Represents a set of installed packages. Backup saves the output of List and
+// Restore installs the saved packages that are missing (and, with Prune,
+// removes the installed ones that are not saved). Install and Remove receive
+// the package names as arguments, appended to the command.
+type PackageSet struct {
+	Name        string            // Uniquely represents this PackageSet and is also the name of the file inside the backup folder.
+	List        string            // Prints the installed packages, one per line.
+	Install     string            // Installs the packages given as arguments, e.g.: "brew install".
+	Remove      string            `toml:",omitempty"` // Removes the packages given as arguments, e.g.: "brew uninstall". Required by Prune.
+	Prune       bool              `toml:",omitempty"` // Removes the installed packages that are not in the backup when restoring.
+	BatchSize   int               `toml:",omitzero"`  // Maximum number of packages given to each Install/Remove call. All at once if 0.
+	Shell       string            `toml:",omitempty"` // The shell running the commands with -c, sh by default. ShellNone runs them directly.
+	Dir         string            `toml:",omitempty"` // The working directory of the commands.
+	Env         map[string]string `toml:",omitempty"` // Variables added to the inherited environment.
+	Timeout     string            `toml:",omitempty"` // Maximum duration of each command, e.g.: "30m".
+	Serial      bool              `toml:",omitempty"` // Runs alone and in order: after every entry before it and before every entry after it.
+	Parallel    bool              `toml:",omitempty"` // Restores at the same time as other Commands and PackageSets, which are restored one at a time otherwise.
+	Destination string            `toml:",omitempty"` // Overrides Recipe.Destination for this PackageSet. Not supported by encrypted backups.
 }
 
 // Identifies all elements of a backup, specifying what to backup/restore and
-// whether the backup is encrypted. The pair of keys are regenerated every time
-// a backup is done and the dbkp.toml file is created when the Tarball is
-// written in the same folder as the Tarball itself.
+// whether the backup is encrypted. Unencrypted backups may still encrypt some
+// of their entries, see File.Encrypt and Command.Encrypt. The pair of keys
+// are regenerated every time a backup is done and the dbkp.toml file is
+// created when the Tarball is written in the same folder as the Tarball
+// itself.
+//
+// A recipe may include other recipe files. Their entries are merged by Name:
+// an entry of a later file (the including one comes last) replaces only the
+// fields it sets of the entry with the same Name, and the top level settings
+// it sets replace the included ones. EncryptionSalt is only read from the
+// including file.
 type Recipe struct {
-	EncryptionSalt [2]string // A pair of randon data. The first is for the key generator and the second for the encryption algorithm.
-	Files          []File    // A list of File to backup/restore.
-	Commands       []Command // A list of Command to backup/restore.
+	Include        []string     `toml:",omitempty"` // Recipe files merged before this one, relative to it. HostnamePlaceholder is replaced by the host name, and files using it are skipped if missing.
+	Disable        []string     `toml:",omitempty"` // Names of entries of the included files to leave out.
+	EncryptionSalt [2]string    // A pair of randon data. The first is for the key generator and the second for the encryption algorithm.
+	Files          []File       // A list of File to backup/restore.
+	Commands       []Command    // A list of Command to backup/restore.
+	Packages       []PackageSet `toml:",omitempty"` // A list of PackageSet to backup/reconcile.
+	SkipRules                   // Default size, age and type limits for every File.
+	SecretPolicy   string       `toml:",omitempty"` // What to do when unencrypted backups contain possible secrets: SecretPolicyWarn (the default), SecretPolicyFail or SecretPolicyOff.
+	Destination    string       `toml:",omitempty"` // The folder the dbkp backup is kept in, absolute or relative to the recipe. The folder of the recipe if empty.
 }
 
-// Loads a recipe from a path. Just a convenience function to parse the TOML
-// file.
-func LoadRecipe(path string) (Recipe, error) {
-	var recipe Recipe
+// Reports whether the whole backup is encrypted.
+func (recipe Recipe) Encrypted() bool {
+	return len(recipe.EncryptionSalt) > 0 && len(recipe.EncryptionSalt[0]) > 0
+}
+
+// Enables encryption of the whole backup by filling EncryptionSalt with random
+// data. The salts are regenerated on every encrypted backup anyway.
+func (recipe *Recipe) EnableEncryption() {
+	iv := make([]byte, 12)
+	salt := make([]byte, 32)
+	rand.Read(iv)
+	rand.Read(salt)
+	recipe.EncryptionSalt = [2]string{hex.EncodeToString(salt), hex.EncodeToString(iv)}
+}
 
-	if _, err := os.Stat(path); err != nil {
-		return recipe, err
+// Reports whether a password is needed to backup or restore the selected
+// names (or all entries, if names is empty): either the whole backup or one of
+// the selected entries is encrypted.
+func (recipe Recipe) NeedsPassword(names []string) bool {
+	if recipe.Encrypted() {
+		return true
 	}
 
-	_, err := toml.DecodeFile(path, &recipe)
+	selected, err := filterRecipeByNames(recipe, names)
 	if err != nil {
-		return recipe, err
+		return false
 	}
 
-	return recipe, nil
+	return selected.hasEncryptedEntries()
+}
+
+// Reports whether any File or Command has Encrypt set.
+func (recipe Recipe) hasEncryptedEntries() bool {
+	for _, file := range recipe.Files {
+		if file.Encrypt {
+			return true
+		}
+	}
+
+	for _, command := range recipe.Commands {
+		if command.Encrypt {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Loads a recipe from a path, merged with the recipe files it includes. See
+// ResolveRecipe to also know where each entry comes from.
+func LoadRecipe(path string) (Recipe, error) {
+	recipe, _, err := ResolveRecipe(path)
+	return recipe, err
 }
 
 // Write an recipe prefilled with some examples to path.
@@ -94,7 +196,7 @@ func WriteExampleRecipe(path string) error {
 		},
 		{
 			Name:    "flatpak",
-			Backup:  "flatpak list --columns=ref --app | tail -n +1",
+			Backup:  "flatpak list --columns=ref --app",
 			Restore: "xargs flatpak install",
 		},
 	}
@@ -105,12 +207,14 @@ func WriteExampleRecipe(path string) error {
 	return recipe.WriteRecipe(path)
 }
 
-// Saves the recipe to a TOML file at path.
+// Saves the recipe to a TOML file at path, as a single file. Use SaveRecipe to
+// save the changes to a recipe loaded with LoadRecipe.
 func (recipe Recipe) WriteRecipe(path string) error {
 	file, err := os.Create(path)
 	if err != nil {
 		return err
 	}
+	defer file.Close()
 
 	encoder := toml.NewEncoder(file)
 	return encoder.Encode(recipe)
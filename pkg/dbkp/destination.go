@@ -0,0 +1,229 @@
+package dbkp
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// A folder holding a backup and the selected entries kept in it.
+type destinationGroup struct {
+	path  string   // The folder holding the dbkp backup.
+	names []string // The selected entries kept in it, in the order of the recipe.
+	set   bool     // Whether path was set with a Destination, instead of being the folder of the recipe.
+}
+
+// Returns the folder holding the backup of the entries with the Destination
+// destination, or of the recipe if it is empty, given the folder of the
+// recipe, path.
+func (recipe Recipe) destinationPath(path string, destination string) (string, error) {
+	if destination == "" {
+		destination = recipe.Destination
+	}
+
+	if destination == "" {
+		return filepath.Abs(path)
+	}
+
+	destination, err := expandHome(destination)
+	if err != nil {
+		return "", err
+	}
+
+	if !filepath.IsAbs(destination) {
+		destination = filepath.Join(path, destination)
+	}
+
+	return filepath.Abs(destination)
+}
+
+// Groups the entries of selected, a selection of recipe, by the folder their
+// backup is kept in, given the folder of the recipe, path. The destination of
+// the recipe comes first, even if none of the selected entries is kept there.
+// Fails if recipe is encrypted and an entry is kept elsewhere, as encrypted
+// backups are a single file.
+func destinationGroups(path string, recipe Recipe, selected Recipe) ([]destinationGroup, error) {
+	main, err := recipe.destinationPath(path, "")
+	if err != nil {
+		return nil, err
+	}
+
+	if recipe.Encrypted() {
+		all, err := groupByDestination(main, path, recipe, recipe)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(all) > 1 {
+			return nil, fmt.Errorf("%s has its own Destination, which encrypted backups do not support", all[1].names[0])
+		}
+	}
+
+	return groupByDestination(main, path, recipe, selected)
+}
+
+// Groups the entries of selected by the folder their backup is kept in,
+// starting with main.
+func groupByDestination(main string, path string, recipe Recipe, selected Recipe) ([]destinationGroup, error) {
+	groups := []destinationGroup{{path: main, set: recipe.Destination != ""}}
+
+	add := func(name string, destination string) error {
+		folder, err := recipe.destinationPath(path, destination)
+		if err != nil {
+			return &EntryError{Entry: name, Err: err}
+		}
+
+		i := slices.IndexFunc(groups, func(group destinationGroup) bool { return group.path == folder })
+		if i < 0 {
+			groups = append(groups, destinationGroup{path: folder, set: true})
+			i = len(groups) - 1
+		}
+
+		groups[i].names = append(groups[i].names, name)
+		return nil
+	}
+
+	for _, file := range selected.Files {
+		if err := add(file.Name, file.Destination); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, command := range selected.Commands {
+		if err := add(command.Name, command.Destination); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, set := range selected.Packages {
+		if err := add(set.Name, set.Destination); err != nil {
+			return nil, err
+		}
+	}
+
+	return groups, nil
+}
+
+// Returns the destinations of recipe, given the folder of the recipe, path,
+// starting with its own.
+func (recipe Recipe) destinations(path string) ([]string, error) {
+	groups, err := destinationGroups(path, recipe, recipe)
+	if err != nil {
+		return nil, err
+	}
+
+	folders := []string{}
+	for _, group := range groups {
+		folders = append(folders, group.path)
+	}
+
+	return folders, nil
+}
+
+// Fails with ErrDestinationUnavailable if the folder of group was set with a
+// Destination and is not there. It is never created, so that backups do not
+// end up in the mount point of a drive that is not mounted.
+func (group destinationGroup) check() error {
+	if !group.set {
+		return nil
+	}
+
+	path := group.path
+	info, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%w: %s does not exist, is its drive mounted?", ErrDestinationUnavailable, path)
+	} else if err != nil {
+		return fmt.Errorf("%w: %w", ErrDestinationUnavailable, err)
+	}
+
+	if !info.IsDir() {
+		return fmt.Errorf("%w: %s is not a folder", ErrDestinationUnavailable, path)
+	}
+
+	return nil
+}
+
+// Runs run once for each group with entries, with options selecting them,
+// after checking that every destination is available. The reports are merged
+// in the order of selected, and so are the progress reports, as if it was a
+// single run. The password is asked at most once.
+func runInDestinations(options Options, selected Recipe, groups []destinationGroup, run func(options Options, path string) (Report, error)) (Report, error) {
+	begin := time.Now()
+	merged := newReport(selected)
+
+	for _, group := range groups {
+		if len(group.names) > 0 {
+			if err := group.check(); err != nil {
+				return merged, err
+			}
+		}
+	}
+
+	if password := options.Password; password != nil {
+		var key []byte
+		var err error
+		asked := false
+		options.Password = func() ([]byte, error) {
+			if !asked {
+				key, err = password()
+				asked = true
+			}
+			return key, err
+		}
+	}
+
+	progress := options.Progress
+	remaining := 0
+	for _, group := range groups {
+		remaining += len(group.names)
+	}
+
+	var count, bytesDone uint64
+	for _, group := range groups {
+		if len(group.names) == 0 {
+			continue
+		}
+
+		remaining -= len(group.names)
+		groupOptions := options
+		groupOptions.Names = group.names
+		if progress != nil {
+			offset, later, bytes := count, uint64(remaining), bytesDone
+			groupOptions.Progress = func(r ProgressReport) {
+				r.Count += offset
+				r.Total += offset + later
+				r.BytesDone += bytes
+				r.BytesTotal += bytes
+				progress(r)
+			}
+		}
+
+		report, err := run(groupOptions, group.path)
+		for _, entry := range report.Entries {
+			if result := merged.Entry(entry.Name); result != nil {
+				*result = entry
+			}
+		}
+
+		merged.Skipped = append(merged.Skipped, report.Skipped...)
+		merged.Secrets = append(merged.Secrets, report.Secrets...)
+		merged.Failures = append(merged.Failures, report.Failures...)
+		merged.Plans = append(merged.Plans, report.Plans...)
+		merged.BytesDone += report.BytesDone
+		merged.BytesTotal += report.BytesTotal
+		merged.Duration = time.Since(begin)
+
+		if err != nil {
+			return merged, err
+		}
+
+		count += uint64(len(group.names))
+		bytesDone += report.BytesDone
+	}
+
+	return merged, nil
+}
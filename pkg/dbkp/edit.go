@@ -0,0 +1,117 @@
+package dbkp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Returns the entry name encoded as TOML, to be edited by hand and given back
+// to DecodeEntry.
+func (recipe Recipe) EncodeEntry(name string) ([]byte, error) {
+	var entry any
+	if file := recipe.file(name); file != nil {
+		entry = *file
+	} else if command := recipe.command(name); command != nil {
+		entry = *command
+	} else if set := recipe.packageSet(name); set != nil {
+		entry = *set
+	} else {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownEntry, name)
+	}
+
+	var buffer bytes.Buffer
+	if err := toml.NewEncoder(&buffer).Encode(entry); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// Replaces the entry name with the one in data, as encoded by EncodeEntry,
+// after validating it. The Name cannot be changed.
+func (recipe *Recipe) DecodeEntry(name string, data []byte) error {
+	if file := recipe.file(name); file != nil {
+		edited := File{}
+		if err := decodeEntry(name, data, &edited, &edited.Name); err != nil {
+			return err
+		} else if err := edited.Validate(); err != nil {
+			return err
+		}
+		*file = edited
+	} else if command := recipe.command(name); command != nil {
+		edited := Command{}
+		if err := decodeEntry(name, data, &edited, &edited.Name); err != nil {
+			return err
+		} else if err := edited.Validate(); err != nil {
+			return err
+		}
+		*command = edited
+	} else if set := recipe.packageSet(name); set != nil {
+		edited := PackageSet{}
+		if err := decodeEntry(name, data, &edited, &edited.Name); err != nil {
+			return err
+		} else if err := edited.Validate(); err != nil {
+			return err
+		}
+		*set = edited
+	} else {
+		return fmt.Errorf("%w: %s", ErrUnknownEntry, name)
+	}
+
+	return nil
+}
+
+// Decodes data into entry, refusing unknown keys and a Name other than name.
+func decodeEntry(name string, data []byte, entry any, decodedName *string) error {
+	meta, err := toml.Decode(string(data), entry)
+	if err != nil {
+		return err
+	}
+
+	if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+		keys := []string{}
+		for _, key := range undecoded {
+			keys = append(keys, key.String())
+		}
+		return fmt.Errorf("unknown keys: %s", strings.Join(keys, ", "))
+	}
+
+	if *decodedName != name {
+		return errors.New("the Name cannot be changed, rename the entry instead")
+	}
+
+	return nil
+}
+
+// Returns the File name, or nil if there is none.
+func (recipe *Recipe) file(name string) *File {
+	for i := range recipe.Files {
+		if recipe.Files[i].Name == name {
+			return &recipe.Files[i]
+		}
+	}
+	return nil
+}
+
+// Returns the Command name, or nil if there is none.
+func (recipe *Recipe) command(name string) *Command {
+	for i := range recipe.Commands {
+		if recipe.Commands[i].Name == name {
+			return &recipe.Commands[i]
+		}
+	}
+	return nil
+}
+
+// Returns the PackageSet name, or nil if there is none.
+func (recipe *Recipe) packageSet(name string) *PackageSet {
+	for i := range recipe.Packages {
+		if recipe.Packages[i].Name == name {
+			return &recipe.Packages[i]
+		}
+	}
+	return nil
+}
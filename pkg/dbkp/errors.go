@@ -0,0 +1,54 @@
+package dbkp
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	ErrUnknownEntry           = errors.New("unknown entry")           // A name given to select entries is not in the recipe.
+	ErrWrongPassword          = errors.New("wrong password")          // The password does not decrypt the backup, or the encrypted data was modified.
+	ErrCorruptArchive         = errors.New("corrupt archive")         // The backup or an encrypted entry cannot be read.
+	ErrDestinationUnavailable = errors.New("destination unavailable") // The folder the backup is kept in is missing, e.g.: its drive is not mounted.
+)
+
+// A script of a Command or PackageSet that failed.
+type CommandError struct {
+	Entry    string // The Name of the Command or PackageSet.
+	ExitCode int    // The exit code, or -1 if the script did not exit by itself (e.g.: timeout).
+	Stderr   string // What the script wrote to stderr.
+	Err      error  // Why the script failed.
+}
+
+func (e *CommandError) Error() string {
+	stderr := strings.TrimSpace(e.Stderr)
+	if stderr == "" {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%s\n%s", e.Err, stderr)
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+// The failure of the backup or restore of an entry.
+type EntryError struct {
+	Entry string // The Name of the entry.
+	Path  string // The Path of the entry, if it is a File.
+	Err   error  // Why it failed.
+}
+
+func (e *EntryError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Entry, e.Err)
+}
+
+func (e *EntryError) Unwrap() error {
+	return e.Err
+}
+
+// Marks err, found while reading a tarball, as ErrCorruptArchive.
+func corruptArchive(err error) error {
+	return fmt.Errorf("%w: %w", ErrCorruptArchive, err)
+}
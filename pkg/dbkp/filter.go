@@ -1,7 +1,12 @@
 package dbkp
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io/fs"
+	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
@@ -9,23 +14,48 @@ import (
 
 // pathFilter stores the include/exclude settings for walking a directory tree.
 type pathFilter struct {
-	only     map[string]struct{}
+	only     []string
 	excludes []*regexp.Regexp
+	ignores  *ignoreList
+	limits   *fileLimits         // Size, age and type limits, only enforced when backing up.
+	onSkip   func(SkippedFile)   // Called for files skipped because of limits or because they cannot be copied.
+	onCopy   func(string, int64) // Called with the relative path and size of each copied file.
+	onRecord func(ManifestFile)  // Called with the manifest record of each copied file.
+	entry    string              // The name of the entry being walked, to report skipped files.
+	ctx      context.Context     // Stops the walk when cancelled, if not nil.
+	conflict string              // What to do with files that already exist at the destination, one of the Conflict constants.
 }
 
 func newPathFilter(file File) (pathFilter, error) {
-	pf := pathFilter{}
+	pf := pathFilter{ignores: &ignoreList{}}
 
 	if len(file.Only) > 0 {
-		pf.only = make(map[string]struct{}, len(file.Only))
+		pf.only = make([]string, 0, len(file.Only))
 		for _, entry := range file.Only {
-			if entry == "" {
+			pattern := strings.Join(splitSegments(filepath.ToSlash(entry)), "/")
+			if pattern == "" {
 				continue
 			}
-			pf.only[entry] = struct{}{}
+			if err := validateGlob(pattern); err != nil {
+				return pf, fmt.Errorf("invalid only pattern %q: %w", entry, err)
+			}
+			pf.only = append(pf.only, pattern)
 		}
 	}
 
+	switch file.ExcludeSyntax {
+	case "", ExcludeSyntaxRegexp:
+	case ExcludeSyntaxGitignore:
+		patterns, err := parseIgnoreLines("", file.Exclude)
+		if err != nil {
+			return pf, err
+		}
+		pf.ignores.patterns = patterns
+		return pf, nil
+	default:
+		return pf, fmt.Errorf("unknown exclude syntax %q", file.ExcludeSyntax)
+	}
+
 	if len(file.Exclude) > 0 {
 		pf.excludes = make([]*regexp.Regexp, 0, len(file.Exclude))
 		for _, pattern := range file.Exclude {
@@ -45,30 +75,222 @@ func (pf pathFilter) shouldSkip(rel string, isDir bool) (skip bool, skipDir bool
 		return false, false
 	}
 
-	if len(pf.only) > 0 {
-		head := rel
-		if idx := strings.IndexRune(rel, filepath.Separator); idx != -1 {
-			head = rel[:idx]
-		}
-		if _, ok := pf.only[head]; !ok {
-			if isDir {
-				return true, true
-			}
-			return true, false
+	normalized := filepath.ToSlash(rel)
+
+	if len(pf.only) > 0 && !pf.onlyMatches(normalized) {
+		if !isDir || !pf.onlyBelow(normalized) {
+			return true, isDir
 		}
 	}
 
 	if len(pf.excludes) > 0 {
-		normalized := filepath.ToSlash(rel)
 		for _, re := range pf.excludes {
 			if re.MatchString(normalized) {
-				if isDir {
-					return true, true
-				}
-				return true, false
+				return true, isDir
 			}
 		}
 	}
 
+	if pf.ignores.ignores(normalized, isDir) {
+		return true, isDir
+	}
+
 	return false, false
 }
+
+// Returns a copy of the filter that enforces rules on the files it walks.
+func (pf pathFilter) withLimits(rules SkipRules) (pathFilter, error) {
+	limits, err := newFileLimits(rules)
+	if err != nil {
+		return pf, err
+	}
+
+	pf.limits = limits
+	return pf, nil
+}
+
+// Returns a copy of the filter that reports the skipped files of entry to
+// onSkip.
+func (pf pathFilter) reportingTo(entry string, onSkip func(SkippedFile)) pathFilter {
+	pf.entry = entry
+	pf.onSkip = onSkip
+	return pf
+}
+
+// Returns a copy of the filter that reports the relative path and size of
+// each copied file to onCopy.
+func (pf pathFilter) countingTo(onCopy func(rel string, size int64)) pathFilter {
+	pf.onCopy = onCopy
+	return pf
+}
+
+// Returns a copy of the filter that reports the manifest record of each
+// copied file to onRecord.
+func (pf pathFilter) recordingTo(onRecord func(ManifestFile)) pathFilter {
+	pf.onRecord = onRecord
+	return pf
+}
+
+// Reports that the file rel, described by info and whose contents have the
+// SHA-256 sum, was copied.
+func (pf pathFilter) copied(rel string, info fs.FileInfo, sum []byte) {
+	if pf.onCopy != nil {
+		pf.onCopy(filepath.ToSlash(rel), info.Size())
+	}
+
+	if pf.onRecord != nil {
+		pf.onRecord(newManifestFile(rel, info, sum))
+	}
+}
+
+// Returns a copy of the filter that stops walking once ctx is cancelled.
+func (pf pathFilter) cancelledBy(ctx context.Context) pathFilter {
+	pf.ctx = ctx
+	return pf
+}
+
+// Returns the error of the context of the filter, if it was cancelled.
+func (pf pathFilter) cancelled() error {
+	if pf.ctx == nil {
+		return nil
+	}
+	return pf.ctx.Err()
+}
+
+// Returns a copy of the filter that resolves conflicts with existing files
+// according to policy.
+func (pf pathFilter) resolvingConflicts(policy string) pathFilter {
+	pf.conflict = policy
+	return pf
+}
+
+// Applies the conflict policy of the filter to dst, the destination of the
+// file rel, before it is written. sum returns the SHA-256 sum of what will be
+// written, so that ConflictBackup does not keep a copy of a file that is
+// already up to date. Returns whether the file should not be written.
+func (pf pathFilter) resolveConflict(dst string, rel string, sum func() ([]byte, error)) (bool, error) {
+	if pf.conflict == "" || pf.conflict == ConflictOverwrite {
+		return false, nil
+	}
+
+	info, err := os.Lstat(dst)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if pf.conflict == ConflictSkip {
+		pf.skipped(rel, "already exists")
+		return true, nil
+	}
+
+	if info.Mode().IsRegular() {
+		current, err := hashFile(dst)
+		if err != nil {
+			return false, err
+		}
+
+		written, err := sum()
+		if err != nil {
+			return false, err
+		}
+
+		if bytes.Equal(current, written) {
+			return false, nil
+		}
+	}
+
+	// Earlier copies are kept: restoring twice must not lose the original.
+	backup := dst + conflictBackupSuffix
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(backup); errors.Is(err, fs.ErrNotExist) {
+			break
+		} else if err != nil {
+			return false, err
+		}
+		backup = fmt.Sprintf("%s%s.%d", dst, conflictBackupSuffix, i)
+	}
+
+	return false, os.Rename(dst, backup)
+}
+
+// Checks the regular file at path, whose relative path is rel, against the
+// limits and reports it if it should be skipped.
+func (pf pathFilter) skipsFile(path string, rel string, info fs.FileInfo) (bool, error) {
+	reason, err := pf.limits.check(path, info)
+	if err != nil {
+		return false, err
+	}
+
+	if reason == "" {
+		return false, nil
+	}
+
+	pf.skipped(rel, reason)
+	return true, nil
+}
+
+// Reports a file that was skipped.
+func (pf pathFilter) skipped(rel string, reason string) {
+	if pf.onSkip != nil {
+		pf.onSkip(SkippedFile{Entry: pf.entry, Path: filepath.ToSlash(rel), Reason: reason})
+	}
+}
+
+// Loads the ignore file inside the folder dir, whose relative path is rel, so
+// it applies to the rest of the walk.
+func (pf pathFilter) loadIgnoreFile(dir string, rel string) error {
+	if pf.ignores == nil {
+		return nil
+	}
+	return pf.ignores.load(dir, rel)
+}
+
+// skipsPath is like shouldSkip, but for paths that are not reached by walking
+// the tree (i.e.: tarball members), so every parent folder is checked as well.
+func (pf pathFilter) skipsPath(rel string) bool {
+	segments := splitSegments(filepath.ToSlash(rel))
+	for i := 1; i < len(segments); i++ {
+		if skip, _ := pf.shouldSkip(strings.Join(segments[:i], "/"), true); skip {
+			return true
+		}
+	}
+
+	skip, _ := pf.shouldSkip(strings.Join(segments, "/"), false)
+	return skip
+}
+
+// walkOnly reports whether the folder rel is only walked because Only selects
+// something inside it, in which case it should not be created by itself.
+func (pf pathFilter) walkOnly(rel string) bool {
+	if len(pf.only) == 0 || rel == "" {
+		return false
+	}
+	return !pf.onlyMatches(filepath.ToSlash(rel))
+}
+
+// onlyMatches reports whether rel, or one of its parent folders, is selected
+// by one of the Only patterns.
+func (pf pathFilter) onlyMatches(rel string) bool {
+	segments := splitSegments(rel)
+	for _, pattern := range pf.only {
+		for i := 1; i <= len(segments); i++ {
+			if matchGlob(pattern, strings.Join(segments[:i], "/")) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// onlyBelow reports whether some path inside the folder rel could be selected
+// by one of the Only patterns.
+func (pf pathFilter) onlyBelow(rel string) bool {
+	for _, pattern := range pf.only {
+		if matchGlobPrefix(pattern, rel) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,67 @@
+package dbkp
+
+import (
+	"path"
+	"strings"
+)
+
+// matchGlob reports whether name matches pattern. Both are relative paths
+// using `/` as separator. A "**" segment matches zero or more path segments,
+// every other segment is matched with path.Match.
+func matchGlob(pattern string, name string) bool {
+	return matchSegments(splitSegments(pattern), splitSegments(name), false)
+}
+
+// matchGlobPrefix reports whether a path inside the directory dir could match
+// pattern, that is, whether dir has to be walked to find matches.
+func matchGlobPrefix(pattern string, dir string) bool {
+	return matchSegments(splitSegments(pattern), splitSegments(dir), true)
+}
+
+// validateGlob returns an error if any segment of pattern is malformed.
+func validateGlob(pattern string) error {
+	for _, segment := range splitSegments(pattern) {
+		if segment == "**" {
+			continue
+		}
+		if _, err := path.Match(segment, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func matchSegments(pattern []string, name []string, prefix bool) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			rest := pattern[1:]
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(rest, name[i:], prefix) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(name) == 0 {
+			return prefix
+		}
+
+		if ok, err := path.Match(pattern[0], name[0]); err != nil || !ok {
+			return false
+		}
+
+		pattern = pattern[1:]
+		name = name[1:]
+	}
+
+	return len(name) == 0
+}
+
+func splitSegments(p string) []string {
+	p = strings.Trim(path.Clean("/"+p), "/")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
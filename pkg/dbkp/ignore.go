@@ -0,0 +1,155 @@
+package dbkp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Name of the per-folder ignore files honoured when walking backed up folders.
+// They use the same syntax as .gitignore files.
+const ignoreFileName = ".dbkpignore"
+
+// A single gitignore-style pattern.
+type ignorePattern struct {
+	base     string   // Folder, relative to the walked root, whose ignore file declared the pattern.
+	segments []string // The pattern split on `/`, ready for matchSegments.
+	negate   bool     // The pattern started with `!` and re-includes matches.
+	dirOnly  bool     // The pattern ended with `/` and only matches folders.
+}
+
+// The patterns in effect while walking a tree, in increasing precedence. It is
+// shared by pointer so that ignore files found during a walk apply to the rest
+// of it.
+type ignoreList struct {
+	patterns []ignorePattern
+}
+
+// Parses one line of a gitignore-style file. Returns false if the line holds no
+// pattern (blank lines and comments).
+func parseIgnorePattern(base string, line string) (ignorePattern, bool, error) {
+	pattern := ignorePattern{base: base}
+
+	line = strings.TrimRight(line, "\r")
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+		line = strings.TrimSuffix(line, " ")
+	}
+
+	if line == "" || strings.HasPrefix(line, "#") {
+		return pattern, false, nil
+	}
+
+	if strings.HasPrefix(line, "!") {
+		pattern.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, "\\!") || strings.HasPrefix(line, "\\#") {
+		line = line[1:]
+	}
+
+	if strings.HasSuffix(line, "/") {
+		pattern.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+
+	if line == "" {
+		return pattern, false, nil
+	}
+
+	anchored := strings.Contains(line, "/")
+	segments := splitSegments(line)
+	if len(segments) == 0 {
+		return pattern, false, nil
+	}
+
+	if !anchored {
+		segments = append([]string{"**"}, segments...)
+	}
+
+	// "dir/**" matches everything inside dir, but not dir itself.
+	if segments[len(segments)-1] == "**" {
+		segments = append(segments[:len(segments)-1], "*", "**")
+	}
+
+	if err := validateGlob(strings.Join(segments, "/")); err != nil {
+		return pattern, false, fmt.Errorf("invalid ignore pattern %q: %w", line, err)
+	}
+
+	pattern.segments = segments
+	return pattern, true, nil
+}
+
+// Parses the contents of a gitignore-style file found in the folder base.
+func parseIgnoreLines(base string, lines []string) ([]ignorePattern, error) {
+	patterns := []ignorePattern{}
+	for _, line := range lines {
+		pattern, ok, err := parseIgnorePattern(base, line)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns, nil
+}
+
+// Reads the ignore file in the folder dir, whose path relative to the walked
+// root is rel, and appends its patterns to the list. A missing file is not an
+// error.
+func (list *ignoreList) load(dir string, rel string) error {
+	data, err := os.ReadFile(filepath.Join(dir, ignoreFileName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	lines := []string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	patterns, err := parseIgnoreLines(filepath.ToSlash(rel), lines)
+	if err != nil {
+		return fmt.Errorf("%s: %w", filepath.Join(dir, ignoreFileName), err)
+	}
+
+	list.patterns = append(list.patterns, patterns...)
+	return nil
+}
+
+// Reports whether rel (relative to the walked root, using `/`) is ignored. As
+// in git, the last matching pattern decides.
+func (list *ignoreList) ignores(rel string, isDir bool) bool {
+	if list == nil {
+		return false
+	}
+
+	ignored := false
+	segments := splitSegments(rel)
+	for _, pattern := range list.patterns {
+		if pattern.dirOnly && !isDir {
+			continue
+		}
+
+		base := splitSegments(pattern.base)
+		if len(base) >= len(segments) || strings.Join(segments[:len(base)], "/") != strings.Join(base, "/") {
+			continue
+		}
+
+		if matchSegments(pattern.segments, segments[len(base):], false) {
+			ignored = !pattern.negate
+		}
+	}
+
+	return ignored
+}
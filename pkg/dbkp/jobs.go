@@ -0,0 +1,104 @@
+package dbkp
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The backup or restore of a single entry.
+type task struct {
+	name   string                   // The Name of the entry, used in progress reports.
+	path   string                   // The Path of the entry, if it is a File, for errors.
+	serial bool                     // Runs alone: waits for every previous task and blocks the next ones until it finishes.
+	wait   bool                     // Waits for every previous task before starting.
+	phase  string                   // The Phase reported when the task starts.
+	run    func(count uint64) error // Does the work. count is the number of finished tasks when it started, for progress reports.
+}
+
+// Returns the default number of tasks run at the same time.
+func defaultJobs() int {
+	return runtime.NumCPU()
+}
+
+// Runs tasks, up to jobs at the same time (defaultJobs if jobs is not
+// positive), in the order they are given. tracker reports each task when it
+// starts and when it finishes. After a task fails or ctx is cancelled no new
+// tasks are started, and the error of the first failure is returned once the
+// running ones finish.
+func runTasks(ctx context.Context, tasks []task, jobs int, tracker *progressTracker) error {
+	if jobs <= 0 {
+		jobs = defaultJobs()
+	}
+
+	var done atomic.Uint64
+
+	var mutex sync.Mutex
+	var firstErr error
+	failed := func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return firstErr != nil
+	}
+
+	run := func(t task) {
+		count := done.Load()
+		tracker.send(ProgressReport{Count: count, Name: t.name, Phase: t.phase})
+
+		start := time.Now()
+		err := t.run(count)
+		finished := done.Add(1)
+
+		if err != nil {
+			err = &EntryError{Entry: t.name, Path: t.path, Err: err}
+			mutex.Lock()
+			if firstErr == nil {
+				firstErr = err
+			}
+			mutex.Unlock()
+		}
+
+		tracker.send(ProgressReport{Count: finished, Name: t.name, Finished: true, Error: err, Duration: time.Since(start)})
+	}
+
+	slots := make(chan struct{}, jobs)
+	var wg sync.WaitGroup
+
+	for _, t := range tasks {
+		if t.serial || t.wait {
+			wg.Wait()
+		}
+
+		if failed() {
+			break
+		}
+
+		if err := ctx.Err(); err != nil {
+			mutex.Lock()
+			if firstErr == nil {
+				firstErr = err
+			}
+			mutex.Unlock()
+			break
+		}
+
+		if t.serial {
+			run(t)
+			continue
+		}
+
+		slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			run(t)
+		}()
+	}
+
+	wg.Wait()
+
+	return firstErr
+}
@@ -0,0 +1,619 @@
+package dbkp
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Replaced by the host name in the paths of Recipe.Include.
+const HostnamePlaceholder = "{{hostname}}"
+
+// The sections of a recipe holding entries, which are merged by Name.
+var recipeSections = []string{"Files", "Commands", "Packages"}
+
+// Top level keys that are not merged from included files.
+var unmergedKeys = []string{"EncryptionSalt", "Include", "Disable", "Files", "Commands", "Packages"}
+
+// A recipe file as written, without the files it includes, along with the
+// keys it defines, so that it can be saved without adding the others.
+type recipeLayer struct {
+	path    string
+	recipe  Recipe
+	meta    toml.MetaData
+	keys    []string              // The top level keys, as Recipe field names.
+	entries map[string][][]string // The keys of each entry, as field names, by section.
+}
+
+// Loads the recipe file in path, without the files it includes.
+func loadLayer(path string) (*recipeLayer, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+
+	layer := &recipeLayer{path: path, entries: map[string][][]string{}}
+
+	meta, err := toml.DecodeFile(path, &layer.recipe)
+	if err != nil {
+		return nil, err
+	}
+	layer.meta = meta
+
+	recipeType := reflect.TypeOf(Recipe{})
+	for _, key := range meta.Keys() {
+		top := fieldName(recipeType, key[0])
+		if top == "" {
+			continue
+		}
+		layer.addKey(top)
+
+		if !slices.Contains(recipeSections, top) {
+			continue
+		}
+
+		// Every [[Section]] header starts a new entry.
+		entries := layer.entries[top]
+		if len(key) == 1 {
+			if meta.Type(key...) == "ArrayHash" {
+				layer.entries[top] = append(entries, nil)
+			}
+			continue
+		}
+
+		entryType, _ := recipeType.FieldByName(top)
+		if name := fieldName(entryType.Type.Elem(), key[1]); name != "" && len(entries) > 0 {
+			last := len(entries) - 1
+			if !slices.Contains(entries[last], name) {
+				entries[last] = append(entries[last], name)
+			}
+		}
+	}
+
+	// Entries written as inline tables are not listed key by key, they
+	// define what they set.
+	for _, section := range recipeSections {
+		values := layer.section(section)
+		if len(layer.entries[section]) != values.Len() {
+			keys := make([][]string, values.Len())
+			for i := range keys {
+				keys[i] = encodedKeys(values.Index(i))
+			}
+			layer.entries[section] = keys
+		}
+	}
+
+	return layer, nil
+}
+
+// Returns the entries of section, settable.
+func (layer *recipeLayer) section(section string) reflect.Value {
+	return reflect.ValueOf(&layer.recipe).Elem().FieldByName(section)
+}
+
+// Marks the top level key as defined.
+func (layer *recipeLayer) addKey(key string) {
+	if !slices.Contains(layer.keys, key) {
+		layer.keys = append(layer.keys, key)
+	}
+}
+
+// Marks key as defined by the entry at index of section.
+func (layer *recipeLayer) addEntryKey(section string, index int, key string) {
+	if keys := layer.entries[section][index]; !slices.Contains(keys, key) {
+		layer.entries[section][index] = append(keys, key)
+	}
+}
+
+// Adds a new entry to section, defining the keys a recipe written by
+// WriteRecipe would.
+func (layer *recipeLayer) appendEntry(section string, entry reflect.Value) {
+	values := layer.section(section)
+	values.Set(reflect.Append(values, entry))
+	layer.entries[section] = append(layer.entries[section], encodedKeys(entry))
+	layer.addKey(section)
+}
+
+// Removes the entry at index of section.
+func (layer *recipeLayer) removeEntry(section string, index int) {
+	values := layer.section(section)
+	values.Set(reflect.AppendSlice(values.Slice(0, index), values.Slice(index+1, values.Len())))
+	layer.entries[section] = slices.Delete(layer.entries[section], index, index+1)
+}
+
+// Saves the layer to its file, with only the keys it defines.
+func (layer *recipeLayer) write() error {
+	sections := map[string]any{}
+	for _, section := range recipeSections {
+		values := layer.section(section)
+		entries := make([]any, values.Len())
+		for i := range entries {
+			entries[i] = definedFields(values.Index(i), layer.entries[section][i], nil)
+		}
+		sections[section] = entries
+	}
+
+	file, err := os.Create(layer.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return toml.NewEncoder(file).Encode(definedFields(reflect.ValueOf(layer.recipe), layer.keys, sections))
+}
+
+// Returns the name of the field of the struct type t decoded from key, which
+// is matched ignoring case as the TOML decoder does, or "" if there is none.
+func fieldName(t reflect.Type, key string) string {
+	for _, field := range reflect.VisibleFields(t) {
+		if !field.Anonymous && field.IsExported() && strings.EqualFold(field.Name, key) {
+			return field.Name
+		}
+	}
+	return ""
+}
+
+// Returns the names of the fields of the struct value that WriteRecipe would
+// write: the ones without omitempty and the ones that are set.
+func encodedKeys(value reflect.Value) []string {
+	keys := []string{}
+	for _, field := range reflect.VisibleFields(value.Type()) {
+		if field.Anonymous || !field.IsExported() {
+			continue
+		}
+
+		tag := field.Tag.Get("toml")
+		optional := strings.Contains(tag, "omitempty") || strings.Contains(tag, "omitzero")
+		if !optional || !value.FieldByIndex(field.Index).IsZero() {
+			keys = append(keys, field.Name)
+		}
+	}
+	return keys
+}
+
+// Returns a copy of the struct value with only the fields named in keys, in
+// the same order, to encode them even if empty and to leave the others out.
+// Fields in replace are given the value there instead.
+func definedFields(value reflect.Value, keys []string, replace map[string]any) any {
+	fields := []reflect.StructField{}
+	values := []reflect.Value{}
+
+	for _, field := range reflect.VisibleFields(value.Type()) {
+		if field.Anonymous || !slices.Contains(keys, field.Name) {
+			continue
+		}
+
+		fieldValue := value.FieldByIndex(field.Index)
+		if replaced, ok := replace[field.Name]; ok {
+			fieldValue = reflect.ValueOf(replaced)
+		}
+
+		fields = append(fields, reflect.StructField{Name: field.Name, Type: fieldValue.Type()})
+		values = append(values, fieldValue)
+	}
+
+	partial := reflect.New(reflect.StructOf(fields)).Elem()
+	for i, fieldValue := range values {
+		partial.Field(i).Set(fieldValue)
+	}
+
+	return partial.Interface()
+}
+
+// A recipe file that could not be loaded while resolving a layered recipe.
+type layerError struct {
+	path string
+	err  error
+}
+
+func (err *layerError) Error() string {
+	var pathErr *fs.PathError
+	if errors.As(err.err, &pathErr) {
+		return err.err.Error()
+	}
+	return fmt.Sprintf("%s: %s", err.path, err.err)
+}
+
+func (err *layerError) Unwrap() error {
+	return err.err
+}
+
+// Where an entry of a layered recipe comes from.
+type entryOrigin struct {
+	layers  []int          // The layers defining the entry, in order.
+	indexes []int          // The index of the entry in its section of each of those layers.
+	fields  map[string]int // The last layer defining each field.
+}
+
+// A recipe merged from the recipe files it includes.
+type layeredRecipe struct {
+	layers  []*recipeLayer           // The included files, in order, and the recipe itself last.
+	recipe  Recipe                   // The merged recipe.
+	origins map[string][]entryOrigin // Where the entries come from, by section, in the order of the merged recipe.
+	keys    map[string]int           // The last layer defining each merged top level key.
+}
+
+// Loads the recipe in path and the files it includes, and merges them.
+func resolveLayers(path string) (*layeredRecipe, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	layered := &layeredRecipe{origins: map[string][]entryOrigin{}, keys: map[string]int{}}
+	if err := layered.include(path, nil); err != nil {
+		return nil, err
+	}
+
+	for i, layer := range layered.layers {
+		layered.merge(i, layer)
+	}
+
+	main := layered.layers[len(layered.layers)-1].recipe
+	layered.recipe.EncryptionSalt = main.EncryptionSalt
+	layered.recipe.Include = main.Include
+	layered.recipe.Disable = main.Disable
+
+	return layered, nil
+}
+
+// Adds the layers of the files included by the recipe file in path, and then
+// its own. including holds the files including this one, to refuse cycles.
+// Files included more than once are only merged the first time.
+func (layered *layeredRecipe) include(path string, including []string) error {
+	if slices.Contains(including, path) {
+		return &layerError{path, errors.New("the recipe includes itself")}
+	}
+
+	for _, layer := range layered.layers {
+		if layer.path == path {
+			return nil
+		}
+	}
+
+	layer, err := loadLayer(path)
+	if err != nil {
+		return &layerError{path, err}
+	}
+
+	for _, include := range layer.recipe.Include {
+		included, optional, err := includePath(path, include)
+		if err != nil {
+			return &layerError{path, err}
+		}
+
+		if _, err := os.Stat(included); optional && errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+
+		if err := layered.include(included, append(slices.Clone(including), path)); err != nil {
+			return err
+		}
+	}
+
+	layered.layers = append(layered.layers, layer)
+	return nil
+}
+
+// Returns the path of include, an Include of the recipe file in from, and
+// whether it is optional because it depends on the host name.
+func includePath(from string, include string) (string, bool, error) {
+	optional := strings.Contains(include, HostnamePlaceholder)
+	if optional {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return "", false, err
+		}
+		include = strings.ReplaceAll(include, HostnamePlaceholder, hostname)
+	}
+
+	include, err := expandHome(include)
+	if err != nil {
+		return "", false, err
+	}
+
+	if !filepath.IsAbs(include) {
+		include = filepath.Join(filepath.Dir(from), include)
+	}
+
+	return filepath.Clean(include), optional, nil
+}
+
+// Merges the layer at index into the merged recipe: its top level keys replace
+// the merged ones, its Disable removes the merged entries and its entries
+// replace the fields they define of the merged entries with the same Name, or
+// are added.
+func (layered *layeredRecipe) merge(index int, layer *recipeLayer) {
+	merged := reflect.ValueOf(&layered.recipe).Elem()
+	source := reflect.ValueOf(layer.recipe)
+
+	for _, key := range layer.keys {
+		if !slices.Contains(unmergedKeys, key) {
+			merged.FieldByName(key).Set(source.FieldByName(key))
+			layered.keys[key] = index
+		}
+	}
+
+	for _, section := range recipeSections {
+		entries := merged.FieldByName(section)
+		origins := layered.origins[section]
+
+		for i := entries.Len() - 1; i >= 0; i-- {
+			if slices.Contains(layer.recipe.Disable, entries.Index(i).FieldByName("Name").String()) {
+				entries.Set(reflect.AppendSlice(entries.Slice(0, i), entries.Slice(i+1, entries.Len())))
+				origins = slices.Delete(origins, i, i+1)
+			}
+		}
+
+		values := source.FieldByName(section)
+		for i := range values.Len() {
+			entry := values.Index(i)
+			keys := layer.entries[section][i]
+			name := entry.FieldByName("Name").String()
+
+			// Entries of earlier layers are overridden, but two entries with
+			// the same Name in one file are kept as they are.
+			target := -1
+			for j := range entries.Len() {
+				definedBy := origins[j].layers[len(origins[j].layers)-1]
+				if definedBy != index && entries.Index(j).FieldByName("Name").String() == name {
+					target = j
+					break
+				}
+			}
+
+			if target < 0 {
+				entries.Set(reflect.Append(entries, entry))
+				origins = append(origins, entryOrigin{fields: map[string]int{}})
+				target = len(origins) - 1
+			} else {
+				for _, key := range keys {
+					entries.Index(target).FieldByName(key).Set(entry.FieldByName(key))
+				}
+			}
+
+			origin := &origins[target]
+			origin.layers = append(origin.layers, index)
+			origin.indexes = append(origin.indexes, i)
+			for _, key := range keys {
+				origin.fields[key] = index
+			}
+		}
+
+		layered.origins[section] = origins
+	}
+}
+
+// Returns the layer defining key of the entry at index of section last, or
+// defining the entry last if none defines key, and the index of the entry in
+// that layer.
+func (layered *layeredRecipe) entryLayer(section string, index int, key string) (int, int) {
+	origin := layered.origins[section][index]
+
+	layer, ok := origin.fields[key]
+	if !ok {
+		layer = origin.layers[len(origin.layers)-1]
+	}
+
+	return layer, origin.indexes[slices.Index(origin.layers, layer)]
+}
+
+// Loads the recipe in path merged with the recipe files it includes, and the
+// files each entry comes from, by Name: the first one adds it and the others
+// override some of its fields.
+func ResolveRecipe(path string) (Recipe, map[string][]string, error) {
+	layered, err := resolveLayers(path)
+	if err != nil {
+		return Recipe{}, nil, err
+	}
+
+	sources := map[string][]string{}
+	for section, origins := range layered.origins {
+		entries := reflect.ValueOf(layered.recipe).FieldByName(section)
+		for i, origin := range origins {
+			name := entries.Index(i).FieldByName("Name").String()
+			for _, layer := range origin.layers {
+				sources[name] = append(sources[name], layered.layers[layer].path)
+			}
+		}
+	}
+
+	return layered.recipe, sources, nil
+}
+
+// Saves recipe, loaded from path with LoadRecipe and then changed, to the
+// recipe file in path, leaving the files it includes as they are: they may be
+// shared with other machines, and are changed by giving them as path instead.
+// Changes to entries of included files are saved as entries overriding them,
+// and removing them adds them to Disable. EncryptionSalt is left as it is,
+// backups save it. The file is only written if something changed. If path
+// does not exist, recipe is written to it.
+func SaveRecipe(path string, recipe Recipe) error {
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		return recipe.WriteRecipe(path)
+	}
+
+	layered, err := resolveLayers(path)
+	if err != nil {
+		return err
+	}
+
+	main := len(layered.layers) - 1
+	target := layered.layers[main]
+	dirty := false
+
+	current := reflect.ValueOf(layered.recipe)
+	changed := reflect.ValueOf(recipe)
+
+	for _, field := range reflect.VisibleFields(current.Type()) {
+		if field.Anonymous || slices.Contains(recipeSections, field.Name) || field.Name == "EncryptionSalt" {
+			continue
+		}
+
+		value := changed.FieldByIndex(field.Index)
+		if reflect.DeepEqual(current.FieldByIndex(field.Index).Interface(), value.Interface()) {
+			continue
+		}
+
+		reflect.ValueOf(&target.recipe).Elem().FieldByIndex(field.Index).Set(value)
+		target.addKey(field.Name)
+		dirty = true
+	}
+
+	for _, section := range recipeSections {
+		entries := current.FieldByName(section)
+		wanted := changed.FieldByName(section)
+		matched := make([]bool, entries.Len())
+
+		for i := range wanted.Len() {
+			entry := wanted.Index(i)
+			name := entry.FieldByName("Name").String()
+
+			j := -1
+			for k := range entries.Len() {
+				if !matched[k] && entries.Index(k).FieldByName("Name").String() == name {
+					j = k
+					break
+				}
+			}
+
+			if j < 0 {
+				target.appendEntry(section, entry)
+				dirty = true
+				continue
+			}
+			matched[j] = true
+
+			index, ok := layered.origins[section][j].indexIn(main)
+			for _, field := range reflect.VisibleFields(entry.Type()) {
+				if field.Anonymous {
+					continue
+				}
+
+				value := entry.FieldByIndex(field.Index)
+				if reflect.DeepEqual(entries.Index(j).FieldByIndex(field.Index).Interface(), value.Interface()) {
+					continue
+				}
+
+				// Entries of included files are overridden by an entry with
+				// the same Name and only the changed keys.
+				if !ok {
+					override := reflect.New(entry.Type()).Elem()
+					override.FieldByName("Name").SetString(name)
+					target.appendEntry(section, override)
+					index, ok = target.section(section).Len()-1, true
+					target.entries[section][index] = []string{"Name"}
+				}
+
+				target.section(section).Index(index).FieldByIndex(field.Index).Set(value)
+				target.addEntryKey(section, index, field.Name)
+				dirty = true
+			}
+		}
+
+		// Removed last, from the end, so that the indexes stay valid.
+		removed := []int{}
+		for j, ok := range matched {
+			if ok {
+				continue
+			}
+
+			origin := layered.origins[section][j]
+			if index, ok := origin.indexIn(main); ok {
+				removed = append(removed, index)
+			}
+
+			if origin.layers[0] != main {
+				name := entries.Index(j).FieldByName("Name").String()
+				if !slices.Contains(target.recipe.Disable, name) {
+					target.recipe.Disable = append(target.recipe.Disable, name)
+					target.addKey("Disable")
+				}
+			}
+			dirty = true
+		}
+
+		slices.Sort(removed)
+		for _, index := range slices.Backward(removed) {
+			target.removeEntry(section, index)
+		}
+	}
+
+	if !dirty {
+		return nil
+	}
+
+	return target.write()
+}
+
+// Returns the index of the entry in its section of layer, if layer defines it.
+func (origin entryOrigin) indexIn(layer int) (int, bool) {
+	i := slices.Index(origin.layers, layer)
+	if i < 0 {
+		return 0, false
+	}
+	return origin.indexes[i], true
+}
+
+// Renames the entry oldName of the recipe file in path to newName, in place.
+// Entries of included files are disabled instead, and recipe, where the entry
+// is already renamed, saved with SaveRecipe, so that they get a renamed copy.
+// If path does not exist, recipe is written to it instead.
+func renameInRecipe(path string, recipe Recipe, oldName string, newName string) error {
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		return recipe.WriteRecipe(path)
+	}
+
+	layered, err := resolveLayers(path)
+	if err != nil {
+		return err
+	}
+
+	main := len(layered.layers) - 1
+	target := layered.layers[main]
+	dirty := false
+	for _, section := range recipeSections {
+		entries := reflect.ValueOf(layered.recipe).FieldByName(section)
+		for i, origin := range layered.origins[section] {
+			if entries.Index(i).FieldByName("Name").String() != oldName {
+				continue
+			}
+
+			if origin.layers[0] != main {
+				return SaveRecipe(path, recipe)
+			}
+
+			index, _ := origin.indexIn(main)
+			target.section(section).Index(index).FieldByName("Name").SetString(newName)
+			dirty = true
+		}
+	}
+
+	if !dirty {
+		return nil
+	}
+
+	return target.write()
+}
+
+// Saves the EncryptionSalt of recipe to the recipe file in path, and nothing
+// else, leaving the files it includes as they are. If path does not exist,
+// recipe is written to it.
+func saveEncryptionSalt(path string, recipe Recipe) error {
+	layer, err := loadLayer(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return recipe.WriteRecipe(path)
+	} else if err != nil {
+		return err
+	}
+
+	layer.recipe.EncryptionSalt = recipe.EncryptionSalt
+	layer.addKey("EncryptionSalt")
+	return layer.write()
+}
@@ -0,0 +1,164 @@
+package dbkp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Name of the manifest, inside the dbkp folder of plain backups or inside the
+// tarball of encrypted ones.
+const manifestName = ".dbkp-manifest.toml"
+
+// Describes what a backup contains, so that truncated or modified backups can
+// be detected.
+type Manifest struct {
+	Version  string          // The version of dbkp that made the backup.
+	Hostname string          // The host where the backup was made.
+	Created  time.Time       // When the backup was made.
+	Entries  []ManifestEntry `toml:",omitempty"` // What was stored for each entry.
+}
+
+// What the backup of an entry stored.
+type ManifestEntry struct {
+	Name      string
+	Kind      string         // file, command or packages.
+	Created   time.Time      // When the entry was backed up.
+	Encrypted bool           `toml:",omitempty"` // Whether the entry is stored encrypted inside a plain backup.
+	Files     []ManifestFile `toml:",omitempty"` // For File entries, the files copied.
+	Output    *ManifestFile  `toml:",omitempty"` // For Commands and PackageSets, the output saved.
+	Stderr    *ManifestFile  `toml:",omitempty"` // For Commands with SaveStderr, the stderr saved.
+	ExitCode  *int           `toml:",omitempty"` // For Commands, the exit code of Backup.
+	Skipped   bool           `toml:",omitempty"` // For Commands, whether Backup failed with OnFailure skip, so nothing was saved.
+}
+
+// A file stored in a backup.
+type ManifestFile struct {
+	Path    string    `toml:",omitempty"` // Relative to the Path of the entry, empty if the entry is a single file.
+	Size    int64     // The size in bytes.
+	Mode    string    `toml:",omitempty"` // The permissions of the original file, in octal.
+	ModTime time.Time `toml:",omitzero"`  // The modification time of the original file.
+	SHA256  string    // The SHA-256 sum of the contents, in hexadecimal.
+}
+
+// Creates an empty manifest for a backup made now on this host.
+func newManifest() Manifest {
+	hostname, _ := os.Hostname()
+	return Manifest{Version: strings.TrimSpace(Version), Hostname: hostname, Created: time.Now()}
+}
+
+// Creates the record of the file rel, described by info and whose contents
+// have the SHA-256 sum.
+func newManifestFile(rel string, info fs.FileInfo, sum []byte) ManifestFile {
+	return ManifestFile{
+		Path:    filepath.ToSlash(rel),
+		Size:    info.Size(),
+		Mode:    fmt.Sprintf("%04o", info.Mode().Perm()),
+		ModTime: info.ModTime(),
+		SHA256:  hex.EncodeToString(sum),
+	}
+}
+
+// Creates the record of the output of a Command or PackageSet.
+func newOutputRecord(data []byte) *ManifestFile {
+	sum := sha256.Sum256(data)
+	return &ManifestFile{Size: int64(len(data)), SHA256: hex.EncodeToString(sum[:])}
+}
+
+// Replaces the entries whose names are in replaced with entries, keeping the
+// order of the others.
+func (manifest *Manifest) update(replaced map[string]struct{}, entries []ManifestEntry) {
+	kept := []ManifestEntry{}
+	for _, entry := range manifest.Entries {
+		if _, ok := replaced[entry.Name]; !ok {
+			kept = append(kept, entry)
+		}
+	}
+
+	manifest.Entries = append(kept, entries...)
+}
+
+// Reports whether the backup of the entry name stored nothing, as it is a File
+// entry whose files were all skipped or a skipped Command.
+func (manifest Manifest) storedNothing(name string) bool {
+	entry := manifest.entry(name)
+	return entry != nil && (entry.Skipped || entry.Kind == "file" && len(entry.Files) == 0)
+}
+
+// Returns the entry name, or nil if there is none.
+func (manifest Manifest) entry(name string) *ManifestEntry {
+	for i := range manifest.Entries {
+		if manifest.Entries[i].Name == name {
+			return &manifest.Entries[i]
+		}
+	}
+	return nil
+}
+
+func (manifest Manifest) encode() ([]byte, error) {
+	var buffer bytes.Buffer
+	if err := toml.NewEncoder(&buffer).Encode(manifest); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func parseManifest(data []byte) (Manifest, error) {
+	manifest := Manifest{}
+	if _, err := toml.Decode(string(data), &manifest); err != nil {
+		return manifest, corruptArchive(fmt.Errorf("%s: %w", manifestName, err))
+	}
+
+	for _, entry := range manifest.Entries {
+		if err := validateName(entry.Name); err != nil {
+			return manifest, corruptArchive(fmt.Errorf("%s: %w", manifestName, err))
+		}
+	}
+
+	return manifest, nil
+}
+
+// Reads the manifest of the plain backup in backupFolder.
+func readManifest(backupFolder string) (Manifest, error) {
+	data, err := os.ReadFile(filepath.Join(backupFolder, manifestName))
+	if err != nil {
+		return Manifest{}, err
+	}
+	return parseManifest(data)
+}
+
+// Keeps the entries of recorded that are not nil, in order, and adds them to
+// the manifest, replacing the entries named in replaced. If previous is not
+// nil, it is updated instead of starting an empty manifest.
+func buildManifest(previous *Manifest, replaced map[string]struct{}, recorded []*ManifestEntry) Manifest {
+	manifest := newManifest()
+	if previous != nil {
+		manifest.Entries = previous.Entries
+	}
+
+	entries := []ManifestEntry{}
+	for _, entry := range recorded {
+		if entry != nil {
+			entries = append(entries, *entry)
+			replaced[entry.Name] = struct{}{}
+		}
+	}
+
+	manifest.update(replaced, entries)
+	return manifest
+}
+
+// Renames the entry oldName, if there is one, to newName.
+func (manifest *Manifest) rename(oldName string, newName string) {
+	if entry := manifest.entry(oldName); entry != nil {
+		entry.Name = newName
+	}
+}
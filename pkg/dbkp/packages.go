@@ -0,0 +1,287 @@
+package dbkp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// What Restore would do to reconcile a PackageSet with the backup.
+type PackagePlan struct {
+	Entry   string   // The Name of the PackageSet.
+	Install []string // Saved packages that are not installed.
+	Remove  []string // Installed packages that are not saved, if Prune is set.
+}
+
+// Reports whether the plan has nothing to do.
+func (plan PackagePlan) Empty() bool {
+	return len(plan.Install) == 0 && len(plan.Remove) == 0
+}
+
+// Returns a Command carrying the execution settings of set, to run its
+// scripts with executeCommand.
+func (set PackageSet) command() Command {
+	return Command{Name: set.Name, Shell: set.Shell, Dir: set.Dir, Env: set.Env, Timeout: set.Timeout}
+}
+
+func (set PackageSet) validate() error {
+	if set.List == "" || set.Install == "" {
+		return errors.New("List and Install are required")
+	}
+
+	if set.Prune && set.Remove == "" {
+		return errors.New("Prune requires Remove")
+	}
+
+	if set.BatchSize < 0 {
+		return fmt.Errorf("invalid BatchSize %d", set.BatchSize)
+	}
+
+	return nil
+}
+
+// Runs List and returns the installed packages, sorted and without
+// duplicates.
+func (set PackageSet) installed(ctx context.Context) ([]string, error) {
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+
+	command := set.command()
+	if err := executeCommand(ctx, command, set.List, command.Timeout, nil, &stdout, &stderr); err != nil {
+		return nil, &CommandError{Entry: set.Name, ExitCode: exitCode(err), Stderr: stderr.String(), Err: err}
+	}
+
+	return parsePackageList(stdout.Bytes()), nil
+}
+
+// Validates set and returns the list of installed packages to be saved in the
+// backup.
+func (set PackageSet) backup(ctx context.Context) ([]byte, error) {
+	if err := set.validate(); err != nil {
+		return nil, err
+	}
+
+	packages, err := set.installed(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return formatPackageList(packages), nil
+}
+
+// Parses a list of packages, one per line, into a sorted list without
+// duplicates or empty lines.
+func parsePackageList(data []byte) []string {
+	packages := []string{}
+	for line := range strings.SplitSeq(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			packages = append(packages, line)
+		}
+	}
+
+	slices.Sort(packages)
+	return slices.Compact(packages)
+}
+
+// Formats a list of packages as saved in the backup.
+func formatPackageList(packages []string) []byte {
+	if len(packages) == 0 {
+		return []byte{}
+	}
+
+	return []byte(strings.Join(packages, "\n") + "\n")
+}
+
+// Compares the saved packages with the installed ones.
+func (set PackageSet) plan(ctx context.Context, saved []string) (PackagePlan, error) {
+	plan := PackagePlan{Entry: set.Name, Install: []string{}, Remove: []string{}}
+
+	current, err := set.installed(ctx)
+	if err != nil {
+		return plan, err
+	}
+
+	for _, name := range saved {
+		if _, found := slices.BinarySearch(current, name); !found {
+			plan.Install = append(plan.Install, name)
+		}
+	}
+
+	if set.Prune {
+		for _, name := range current {
+			if _, found := slices.BinarySearch(saved, name); !found {
+				plan.Remove = append(plan.Remove, name)
+			}
+		}
+	}
+
+	return plan, nil
+}
+
+// Runs script (Install or Remove) with packages in batches of BatchSize. When
+// a batch fails, its packages are retried one by one so the failures can be
+// told apart. Returns the packages that failed, and ctx's error if it was
+// cancelled before every package was tried.
+func (set PackageSet) apply(ctx context.Context, script string, packages []string) ([]CommandFailure, error) {
+	failures := []CommandFailure{}
+
+	size := set.BatchSize
+	if size == 0 {
+		size = max(len(packages), 1)
+	}
+
+	for batch := range slices.Chunk(packages, size) {
+		if err := ctx.Err(); err != nil {
+			return failures, err
+		}
+
+		stderr, err := set.run(ctx, script, batch)
+		if err == nil {
+			continue
+		}
+
+		if len(batch) == 1 {
+			if ctx.Err() != nil {
+				return failures, ctx.Err()
+			}
+			failures = append(failures, set.failure(batch[0], err, stderr))
+			continue
+		}
+
+		for _, name := range batch {
+			if err := ctx.Err(); err != nil {
+				return failures, err
+			}
+
+			if stderr, err := set.run(ctx, script, []string{name}); err != nil {
+				if ctx.Err() != nil {
+					return failures, ctx.Err()
+				}
+				failures = append(failures, set.failure(name, err, stderr))
+			}
+		}
+	}
+
+	return failures, nil
+}
+
+// Runs script with packages appended as arguments, returning its stderr.
+func (set PackageSet) run(ctx context.Context, script string, packages []string) (string, error) {
+	var stderr bytes.Buffer
+
+	args := make([]string, 0, len(packages)+1)
+	args = append(args, script)
+	for _, name := range packages {
+		args = append(args, shellQuote(name))
+	}
+
+	command := set.command()
+	err := executeCommand(ctx, command, strings.Join(args, " "), command.Timeout, nil, nil, &stderr)
+	return stderr.String(), err
+}
+
+func (set PackageSet) failure(name string, err error, stderr string) CommandFailure {
+	return CommandFailure{
+		Entry:    set.Name,
+		Package:  name,
+		ExitCode: exitCode(err),
+		Error:    err.Error(),
+		Stderr:   stderr,
+	}
+}
+
+// Quotes value so a POSIX shell (or splitArgs) reads it as a single argument.
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+// Returns the packages saved for set in the plain backup folder or in the
+// encrypted tarball.
+func savedPackages(backupPath string, tar *Tarball, set PackageSet) ([]string, error) {
+	if tar != nil {
+		data, err := tar.readFile(set.Name)
+		if err != nil {
+			return nil, err
+		}
+		return parsePackageList(data.Bytes()), nil
+	}
+
+	data, err := readFile(filepath.Join(backupPath, set.Name))
+	if err != nil {
+		return nil, err
+	}
+
+	return parsePackageList(data), nil
+}
+
+// Reconciles set with the saved packages, which is step count of total,
+// reporting each package that could not be installed or removed to pr. Stops
+// with ctx's error if it is cancelled.
+func restorePackages(ctx context.Context, set PackageSet, saved []string, pr chan<- ProgressReport, count uint64, total uint64) error {
+	if err := set.validate(); err != nil {
+		return err
+	}
+
+	plan, err := set.plan(ctx, saved)
+	if err != nil {
+		return err
+	}
+
+	if plan.Empty() {
+		if pr != nil {
+			pr <- ProgressReport{Count: count, Total: total, Name: set.Name, Message: "already up to date"}
+		}
+		return nil
+	}
+
+	failures, err := set.apply(ctx, set.Install, plan.Install)
+	if err == nil && len(plan.Remove) > 0 {
+		var removeFailures []CommandFailure
+		removeFailures, err = set.apply(ctx, set.Remove, plan.Remove)
+		failures = append(failures, removeFailures...)
+	}
+
+	for _, failure := range failures {
+		reportFailure(pr, count, total, &failure)
+	}
+
+	return err
+}
+
+// Computes what restoring the PackageSets of the selected recipe from the
+// backup in backupPath would do, without changing anything.
+func planPackages(ctx context.Context, backupPath string, selected Recipe, password []byte) ([]PackagePlan, error) {
+	var tar *Tarball
+	if len(selected.Packages) > 0 && selected.Encrypted() {
+		loaded, err := loadTarball(backupPath, password, selected)
+		if err != nil {
+			return nil, err
+		}
+		tar = &loaded
+	}
+
+	plans := []PackagePlan{}
+	for _, set := range selected.Packages {
+		if err := set.validate(); err != nil {
+			return nil, &EntryError{Entry: set.Name, Err: err}
+		}
+
+		saved, err := savedPackages(backupPath, tar, set)
+		if err != nil {
+			return nil, &EntryError{Entry: set.Name, Err: err}
+		}
+
+		plan, err := set.plan(ctx, saved)
+		if err != nil {
+			return nil, &EntryError{Entry: set.Name, Err: err}
+		}
+
+		plans = append(plans, plan)
+	}
+
+	return plans, nil
+}
@@ -0,0 +1,70 @@
+package dbkp
+
+import (
+	_ "embed"
+	"fmt"
+
+	"github.com/BurntSushi/toml"
+)
+
+//go:embed presets.toml
+var presetsCatalog string
+
+// A vetted entry for a common package manager or setting, which can be added
+// to a recipe by name. Exactly one of Command and Packages is set.
+type Preset struct {
+	Name        string      // The name used to add the preset, also the Name of the entry.
+	Description string      // What the preset backs up.
+	Command     *Command    // The Command entry, if the preset is a Command.
+	Packages    *PackageSet // The PackageSet entry, if the preset is a PackageSet.
+}
+
+// Returns the catalog of presets embedded in the binary.
+func Presets() ([]Preset, error) {
+	var catalog struct {
+		Presets []Preset
+	}
+
+	if _, err := toml.Decode(presetsCatalog, &catalog); err != nil {
+		return nil, err
+	}
+
+	for i := range catalog.Presets {
+		preset := &catalog.Presets[i]
+		if preset.Command != nil {
+			preset.Command.Name = preset.Name
+		}
+		if preset.Packages != nil {
+			preset.Packages.Name = preset.Name
+		}
+	}
+
+	return catalog.Presets, nil
+}
+
+// Returns the preset called name.
+func FindPreset(name string) (Preset, error) {
+	presets, err := Presets()
+	if err != nil {
+		return Preset{}, err
+	}
+
+	for _, preset := range presets {
+		if preset.Name == name {
+			return preset, nil
+		}
+	}
+
+	return Preset{}, fmt.Errorf("unknown preset: %s", name)
+}
+
+// Adds the entry of preset to recipe.
+func (recipe *Recipe) AddPreset(preset Preset) {
+	if preset.Command != nil {
+		recipe.Commands = append(recipe.Commands, *preset.Command)
+	}
+
+	if preset.Packages != nil {
+		recipe.Packages = append(recipe.Packages, *preset.Packages)
+	}
+}
@@ -0,0 +1,103 @@
+package dbkp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+// Set in the environment of the copy of the test binary started by
+// TestCommandReadsTerminal.
+const terminalChildEnv = "DBKP_TEST_TERMINAL_CHILD"
+
+// Opens a new pseudo-terminal, returning its master and the path of its slave.
+func openPty(t *testing.T) (*os.File, string) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR, 0)
+	if err != nil {
+		t.Skipf("no pseudo-terminals: %s", err)
+	}
+
+	var number uint32
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, master.Fd(), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&number))); errno != 0 {
+		t.Fatal(errno)
+	}
+
+	var unlock int32
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, master.Fd(), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); errno != 0 {
+		t.Fatal(errno)
+	}
+
+	return master, fmt.Sprintf("/dev/pts/%d", number)
+}
+
+// Runs a command reading from the terminal, as sudo does, in a copy of the
+// test binary whose controlling terminal is a pseudo-terminal. The command is
+// stopped for good if it is not in the foreground process group.
+func TestCommandReadsTerminal(t *testing.T) {
+	if os.Getenv(terminalChildEnv) != "" {
+		var stdout, stderr bytes.Buffer
+		command := Command{Name: "tty", Backup: "read line </dev/tty && echo \"got $line\""}
+		if _, err := executeBackup(context.Background(), command, &stdout, &stderr); err != nil {
+			fmt.Printf("failed: %s %s\n", err, stderr.String())
+			os.Exit(1)
+		}
+		fmt.Print(stdout.String())
+		os.Exit(0)
+	}
+
+	master, slavePath := openPty(t)
+	defer master.Close()
+
+	slave, err := os.OpenFile(slavePath, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slave.Close()
+
+	child := exec.Command(os.Args[0], "-test.run=^TestCommandReadsTerminal$")
+	child.Env = append(os.Environ(), terminalChildEnv+"=1")
+	child.Stdin = slave
+	child.Stdout = slave
+	child.Stderr = slave
+	child.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true, Ctty: 0}
+	if err := child.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	output := make(chan string)
+	go func() {
+		var read bytes.Buffer
+		buffer := make([]byte, 1024)
+		for !strings.Contains(read.String(), "got ") {
+			n, err := master.Read(buffer)
+			read.Write(buffer[:n])
+			if err != nil {
+				break
+			}
+		}
+		output <- read.String()
+	}()
+
+	if _, err := master.Write([]byte("secret\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case read := <-output:
+		if !strings.Contains(read, "got secret") {
+			t.Errorf("the command did not read the terminal: %q", read)
+		}
+	case <-time.After(10 * time.Second):
+		t.Error("the command hangs reading the terminal")
+	}
+
+	child.Process.Kill()
+	child.Wait()
+}
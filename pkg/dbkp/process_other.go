@@ -0,0 +1,9 @@
+//go:build !unix
+
+package dbkp
+
+import "os/exec"
+
+// Process groups are not supported on this platform, only the command itself
+// is killed when cancelled.
+func setProcessGroup(cmd *exec.Cmd, timeout bool) {}
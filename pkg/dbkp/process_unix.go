@@ -0,0 +1,36 @@
+//go:build unix
+
+package dbkp
+
+import (
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+)
+
+// Whether dbkp has a controlling terminal.
+var hasTerminal = sync.OnceValue(func() bool {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return false
+	}
+	tty.Close()
+	return true
+})
+
+// Starts cmd in its own process group and makes cancelling it kill the whole
+// group, so that children of the shell do not outlive it. This is only done
+// for scripts with a timeout, or when there is no terminal: a background group
+// is stopped as soon as it reads from the terminal, e.g. for a sudo password.
+// Those scripts get Ctrl-C from the terminal instead.
+func setProcessGroup(cmd *exec.Cmd, timeout bool) {
+	if !timeout && hasTerminal() {
+		return
+	}
+
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
@@ -0,0 +1,135 @@
+package dbkp
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+// Values of ProgressReport.Phase.
+const (
+	PhaseScanning   = "scanning"        // Measuring the files to be copied, before anything is done.
+	PhaseCopying    = "copying"         // Copying the files of a File entry.
+	PhaseEncrypting = "encrypting"      // Encrypting the backup, or an entry with Encrypt set.
+	PhaseDecrypting = "decrypting"      // Decrypting the backup, or an entry with Encrypt set.
+	PhaseRunning    = "running command" // Running a Command or the commands of a PackageSet.
+)
+
+// Sends the reports of a backup or restore to pr, keeping track of the bytes
+// copied so far.
+type progressTracker struct {
+	pr         chan<- ProgressReport
+	total      uint64        // The number of entries.
+	bytesTotal uint64        // The bytes to be copied, as measured by the pre-scan.
+	bytesDone  atomic.Uint64 // The bytes copied so far.
+}
+
+func newProgressTracker(pr chan<- ProgressReport, total uint64) *progressTracker {
+	return &progressTracker{pr: pr, total: total}
+}
+
+// Sends report to pr, filling Total and the byte counts.
+func (tracker *progressTracker) send(report ProgressReport) {
+	if tracker.pr == nil {
+		return
+	}
+
+	report.Total = tracker.total
+	report.BytesDone = tracker.bytesDone.Load()
+	report.BytesTotal = tracker.bytesTotal
+	tracker.pr <- report
+}
+
+// Adds the size of the entry name, measured by measure, to the bytes to be
+// copied. Errors are ignored, as they are reported when the entry is copied.
+func (tracker *progressTracker) scan(name string, measure func() (uint64, error)) {
+	tracker.send(ProgressReport{Name: name, Phase: PhaseScanning})
+
+	size, _ := measure()
+	tracker.bytesTotal += size
+}
+
+// Returns a function reporting the files copied by the entry name, which
+// started as step count, to be used with pathFilter.countingTo.
+func (tracker *progressTracker) copied(count uint64, name string) func(string, int64) {
+	return func(rel string, size int64) {
+		tracker.bytesDone.Add(uint64(size))
+		tracker.send(ProgressReport{Count: count, Name: name, Phase: PhaseCopying, File: rel})
+	}
+}
+
+// Sums the sizes of the files in path that would be copied with filter. filter
+// should not be used for anything else, as it loads the ignore files it
+// finds.
+func measureFileOrFolder(path string, filter pathFilter) (uint64, error) {
+	fileinfo, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+
+	if fileinfo.Mode().IsRegular() {
+		if skip, err := filter.skipsFile(path, "", fileinfo); err != nil || skip {
+			return 0, err
+		}
+		return uint64(fileinfo.Size()), nil
+	} else if !fileinfo.IsDir() {
+		return 0, nil
+	}
+
+	return measureFolder(path, "", filter)
+}
+
+func measureFolder(path string, prefix string, filter pathFilter) (uint64, error) {
+	var size uint64
+
+	err := fs.WalkDir(os.DirFS(path), ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		srcpath := filepath.Join(path, p)
+		if p == "." {
+			return filter.loadIgnoreFile(srcpath, prefix)
+		}
+
+		rel := p
+		if prefix != "" {
+			rel = filepath.Join(prefix, p)
+		}
+
+		fileinfo, err := os.Stat(srcpath)
+		if err != nil {
+			return nil
+		}
+
+		if skip, skipDir := filter.shouldSkip(rel, fileinfo.IsDir()); skip {
+			if skipDir {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		if fileinfo.IsDir() {
+			if d.Type()&fs.ModeSymlink != 0 {
+				linked, err := measureFolder(srcpath, rel, filter)
+				size += linked
+				return err
+			}
+			return filter.loadIgnoreFile(srcpath, rel)
+		}
+
+		if !fileinfo.Mode().IsRegular() {
+			return nil
+		}
+
+		if skip, err := filter.skipsFile(srcpath, rel, fileinfo); err != nil || skip {
+			return err
+		}
+
+		size += uint64(fileinfo.Size())
+		return nil
+	})
+
+	return size, err
+}
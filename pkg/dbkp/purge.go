@@ -0,0 +1,212 @@
+package dbkp
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// Returns the names stored at the top of the backups of recipe, loaded from
+// the file in recipePath, that belong to no entry of recipe kept there, sorted.
+// password is only called if the backup is encrypted.
+func Orphans(recipePath string, recipe Recipe, password func() ([]byte, error)) ([]string, error) {
+	groups, err := destinationGroups(filepath.Dir(recipePath), recipe, recipe)
+	if err != nil {
+		return nil, err
+	}
+
+	orphans := []string{}
+	for _, group := range groups {
+		if err := group.check(); err != nil {
+			return nil, err
+		}
+
+		backupPath := filepath.Join(group.path, "dbkp")
+		contents := backupContents{folder: backupPath}
+		info, err := os.Stat(backupPath)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		if info.Mode().IsRegular() && recipe.Encrypted() {
+			key, err := password()
+			if err != nil {
+				return nil, err
+			}
+
+			tar, err := loadTarball(backupPath, key, recipe)
+			if err != nil {
+				return nil, err
+			}
+			contents.tar = &tar
+		}
+
+		stored, err := contents.names()
+		if err != nil {
+			return nil, err
+		}
+
+		known := recipe.storedNames(group.names)
+		for _, name := range stored {
+			if _, ok := known[name]; !ok && !slices.Contains(orphans, name) {
+				orphans = append(orphans, name)
+			}
+		}
+	}
+
+	slices.Sort(orphans)
+	return orphans, nil
+}
+
+// Returns the names stored at the top of a backup for the entries names of
+// recipe, and for the manifest.
+func (recipe Recipe) storedNames(names []string) map[string]struct{} {
+	known := map[string]struct{}{manifestName: {}}
+	for _, name := range names {
+		known[name] = struct{}{}
+		if recipe.command(name) != nil {
+			known[name+stderrSuffix] = struct{}{}
+		}
+	}
+	return known
+}
+
+// Deletes what is stored for names (and their saved stderr) in the backups of
+// recipe, along with their manifest entries, and saves recipe, loaded from the
+// file in recipePath, to it. Data is kept where an entry of recipe with the
+// same name is kept, so recipe may already lack the purged entries. password
+// is only called if the backup is encrypted, in which case it is rewritten
+// without them.
+func Purge(recipePath string, recipe Recipe, names []string, password func() ([]byte, error)) error {
+	purged := map[string]struct{}{}
+	for _, name := range names {
+		if err := validateName(name); err != nil {
+			return err
+		}
+		purged[name] = struct{}{}
+		purged[name+stderrSuffix] = struct{}{}
+	}
+
+	dir := filepath.Dir(recipePath)
+	groups, err := destinationGroups(dir, recipe, recipe)
+	if err != nil {
+		return err
+	}
+
+	// The entries being removed may be kept where none of recipe is.
+	saved, err := LoadRecipe(recipePath)
+	if err != nil {
+		return err
+	}
+
+	savedGroups, err := destinationGroups(dir, saved, saved)
+	if err != nil {
+		return err
+	}
+
+	for _, group := range savedGroups {
+		if !slices.ContainsFunc(groups, func(other destinationGroup) bool { return other.path == group.path }) {
+			groups = append(groups, destinationGroup{path: group.path, set: group.set})
+		}
+	}
+
+	for _, group := range groups {
+		if err := group.check(); err != nil {
+			return err
+		}
+	}
+
+	for _, group := range groups {
+		known := recipe.storedNames(group.names)
+		here := map[string]struct{}{}
+		for name := range purged {
+			if _, ok := known[name]; !ok {
+				here[name] = struct{}{}
+			}
+		}
+
+		if err := purgeAt(filepath.Join(group.path, "dbkp"), recipePath, recipe, here, password); err != nil {
+			return err
+		}
+	}
+
+	return SaveRecipe(recipePath, recipe)
+}
+
+// Deletes the members in purged from the backup in backupPath, like Purge.
+func purgeAt(backupPath string, recipePath string, recipe Recipe, purged map[string]struct{}, password func() ([]byte, error)) error {
+	if len(purged) == 0 {
+		return nil
+	}
+
+	info, err := os.Stat(backupPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if info.Mode().IsRegular() && recipe.Encrypted() {
+		key, err := password()
+		if err != nil {
+			return err
+		}
+
+		return purgeFromTarball(backupPath, recipePath, recipe, purged, key)
+	}
+
+	for name := range purged {
+		if err := os.RemoveAll(filepath.Join(backupPath, name)); err != nil {
+			return err
+		}
+	}
+
+	manifest, err := readManifest(backupPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	manifest.update(purged, nil)
+	data, err := manifest.encode()
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(backupPath, manifestName), data, 0666)
+}
+
+// Rewrites the encrypted backup in backupPath without the members in purged,
+// saving the new EncryptionSalt to the recipe file in recipePath.
+func purgeFromTarball(backupPath string, recipePath string, recipe Recipe, purged map[string]struct{}, password []byte) error {
+	existing, err := loadTarball(backupPath, password, recipe)
+	if err != nil {
+		return err
+	}
+
+	tarball := Tarball{}
+	tarball.makeWrite()
+
+	err = existing.copyEntries(&tarball, func(name string, contents []byte) (string, []byte, bool, error) {
+		if name == manifestName {
+			manifest, err := parseManifest(contents)
+			if err != nil {
+				return name, nil, false, err
+			}
+			manifest.update(purged, nil)
+			data, err := manifest.encode()
+			return name, data, true, err
+		}
+		return name, contents, !isExcludedEntry(name, purged), nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return tarball.writeToFile(backupPath, recipePath, password, recipe)
+}
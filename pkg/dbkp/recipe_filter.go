@@ -4,9 +4,12 @@ import (
 	"fmt"
 )
 
+// Returns recipe with only the entries in names, or all of them if names is
+// empty. Fails if a name is not in the recipe, or if the Name of a selected
+// entry cannot be used as a file name inside the backup folder.
 func filterRecipeByNames(recipe Recipe, names []string) (Recipe, error) {
 	if len(names) == 0 {
-		return recipe, nil
+		return recipe, recipe.validateNames()
 	}
 
 	known := map[string]struct{}{}
@@ -18,15 +21,20 @@ func filterRecipeByNames(recipe Recipe, names []string) (Recipe, error) {
 		known[command.Name] = struct{}{}
 	}
 
+	for _, set := range recipe.Packages {
+		known[set.Name] = struct{}{}
+	}
+
 	for _, name := range names {
 		if _, ok := known[name]; !ok {
-			return Recipe{}, fmt.Errorf("unknown entry name: %s", name)
+			return Recipe{}, fmt.Errorf("%w: %s", ErrUnknownEntry, name)
 		}
 	}
 
 	selected := recipe
 	selected.Files = nil
 	selected.Commands = nil
+	selected.Packages = nil
 
 	selectedNames := map[string]struct{}{}
 	for _, name := range names {
@@ -45,5 +53,41 @@ func filterRecipeByNames(recipe Recipe, names []string) (Recipe, error) {
 		}
 	}
 
-	return selected, nil
+	for _, set := range recipe.Packages {
+		if _, ok := selectedNames[set.Name]; ok {
+			selected.Packages = append(selected.Packages, set)
+		}
+	}
+
+	return selected, selected.validateNames()
+}
+
+// Checks that the Name of every entry can be used as a file name inside the
+// backup folder, so that no entry is read from or written outside of it.
+func (recipe Recipe) validateNames() error {
+	for _, name := range recipe.names() {
+		if err := validateName(name); err != nil {
+			return &EntryError{Entry: name, Err: err}
+		}
+	}
+
+	return nil
+}
+
+// Returns the Names of the entries, in the order of the recipe.
+func (recipe Recipe) names() []string {
+	names := []string{}
+	for _, file := range recipe.Files {
+		names = append(names, file.Name)
+	}
+
+	for _, command := range recipe.Commands {
+		names = append(names, command.Name)
+	}
+
+	for _, set := range recipe.Packages {
+		names = append(names, set.Name)
+	}
+
+	return names
 }
@@ -0,0 +1,242 @@
+package dbkp
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Renames the entry oldName to newName in recipe, loaded from the file in
+// recipePath, and in the backup it is kept in, if there is one, and saves the
+// recipe. password is only called if stored data has to be decrypted. Refuses
+// names that are not valid file names or that are already used in the recipe
+// or the backup.
+func Rename(recipePath string, recipe Recipe, oldName string, newName string, password func() ([]byte, error)) error {
+	if err := validateName(oldName); err != nil {
+		return err
+	}
+
+	if err := validateName(newName); err != nil {
+		return err
+	}
+
+	if recipe.file(newName) != nil || recipe.command(newName) != nil || recipe.packageSet(newName) != nil {
+		return fmt.Errorf("%s already exists in the recipe", newName)
+	}
+
+	renamed := recipe
+	renamed.Files = slices.Clone(recipe.Files)
+	renamed.Commands = slices.Clone(recipe.Commands)
+	renamed.Packages = slices.Clone(recipe.Packages)
+
+	// File entries are stored as tarballs whose members start with the name,
+	// and Commands may have their stderr saved next to their output.
+	prefixed := false
+	encrypted := false
+	command := false
+	destination := ""
+	if file := renamed.file(oldName); file != nil {
+		file.Name = newName
+		prefixed = true
+		encrypted = file.Encrypt
+		destination = file.Destination
+	} else if entry := renamed.command(oldName); entry != nil {
+		entry.Name = newName
+		command = true
+		destination = entry.Destination
+	} else if set := renamed.packageSet(oldName); set != nil {
+		set.Name = newName
+		destination = set.Destination
+	} else {
+		return fmt.Errorf("%w: %s", ErrUnknownEntry, oldName)
+	}
+
+	folder, err := recipe.destinationPath(filepath.Dir(recipePath), destination)
+	if err != nil {
+		return err
+	}
+	backupPath := filepath.Join(folder, "dbkp")
+
+	info, err := os.Stat(backupPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return renameInRecipe(recipePath, renamed, oldName, newName)
+	} else if err != nil {
+		return err
+	}
+
+	if info.Mode().IsRegular() && recipe.Encrypted() {
+		key, err := password()
+		if err != nil {
+			return err
+		}
+
+		if err := renameInTarball(backupPath, recipePath, recipe, oldName, newName, prefixed, command, key); err != nil {
+			return err
+		}
+	} else if err := renameInFolder(backupPath, oldName, newName, prefixed, encrypted, command, password); err != nil {
+		return err
+	}
+
+	return renameInRecipe(recipePath, renamed, oldName, newName)
+}
+
+// Returns the names stored in a backup for the entry name: the entry itself
+// and, if it is a command, its saved stderr.
+func storedEntryNames(name string, command bool) []string {
+	if command {
+		return []string{name, name + stderrSuffix}
+	}
+	return []string{name}
+}
+
+// Renames the entry stored in the encrypted backup in backupPath, saving the
+// new EncryptionSalt to the recipe file in recipePath.
+func renameInTarball(backupPath string, recipePath string, recipe Recipe, oldName string, newName string, prefixed bool, command bool, password []byte) error {
+	existing, err := loadTarball(backupPath, password, recipe)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range storedEntryNames(newName, command) {
+		if _, err := existing.readFile(name); err == nil {
+			return fmt.Errorf("%s already exists in the backup", name)
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+
+	tarball := Tarball{}
+	tarball.makeWrite()
+
+	err = existing.copyEntries(&tarball, func(name string, contents []byte) (string, []byte, bool, error) {
+		switch {
+		case name == oldName:
+			if prefixed {
+				data, err := renameTarPrefix(contents, oldName, newName)
+				return newName, data, true, err
+			}
+			return newName, contents, true, nil
+		case command && name == oldName+stderrSuffix:
+			return newName + stderrSuffix, contents, true, nil
+		case name == manifestName:
+			manifest, err := parseManifest(contents)
+			if err != nil {
+				return name, nil, false, err
+			}
+			manifest.rename(oldName, newName)
+			data, err := manifest.encode()
+			return name, data, true, err
+		}
+		return name, contents, true, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return tarball.writeToFile(backupPath, recipePath, password, recipe)
+}
+
+// Renames the entry stored in the plain backup folder backupFolder. Encrypted
+// File entries are decrypted, to rename the members of their tarball, with the
+// password returned by password.
+func renameInFolder(backupFolder string, oldName string, newName string, prefixed bool, encrypted bool, command bool, password func() ([]byte, error)) error {
+	for _, name := range storedEntryNames(newName, command) {
+		if _, err := os.Lstat(filepath.Join(backupFolder, name)); err == nil {
+			return fmt.Errorf("%s already exists in the backup", name)
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+
+	manifest, err := readManifest(backupFolder)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	if entry := manifest.entry(oldName); entry != nil {
+		encrypted = entry.Encrypted
+	}
+
+	oldPath := filepath.Join(backupFolder, oldName)
+	newPath := filepath.Join(backupFolder, newName)
+
+	if _, err := os.Lstat(oldPath); errors.Is(err, fs.ErrNotExist) {
+		// Never backed up, nothing stored to move.
+	} else if err != nil {
+		return err
+	} else if prefixed && encrypted {
+		key, err := password()
+		if err != nil {
+			return err
+		}
+
+		data, err := readBlob(oldPath, key)
+		if err != nil {
+			return err
+		}
+
+		if data, err = renameTarPrefix(data, oldName, newName); err != nil {
+			return err
+		}
+
+		if err := writeBlob(newPath, key, data); err != nil {
+			return err
+		}
+
+		if err := os.Remove(oldPath); err != nil {
+			return err
+		}
+	} else if err := os.Rename(oldPath, newPath); err != nil {
+		return err
+	}
+
+	if command {
+		if err := os.Rename(oldPath+stderrSuffix, newPath+stderrSuffix); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+
+	if manifest.entry(oldName) == nil {
+		return nil
+	}
+
+	manifest.rename(oldName, newName)
+	data, err := manifest.encode()
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(backupFolder, manifestName), data, 0666)
+}
+
+// Renames the members of data, a tarball made by tarFileOrFolder for the
+// entry oldName, as if it was made for newName.
+func renameTarPrefix(data []byte, oldName string, newName string) ([]byte, error) {
+	src := Tarball{}
+	src.Buffer.Write(data)
+
+	dst := Tarball{}
+	dst.makeWrite()
+
+	err := src.copyEntries(&dst, func(name string, contents []byte) (string, []byte, bool, error) {
+		if name == oldName {
+			return newName, contents, true, nil
+		} else if rest, ok := strings.CutPrefix(name, oldName+"/"); ok {
+			return newName + "/" + rest, contents, true, nil
+		}
+		return name, contents, true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := dst.closeWrite(); err != nil {
+		return nil, err
+	}
+
+	return dst.Buffer.Bytes(), nil
+}
@@ -2,149 +2,307 @@ package dbkp
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io/fs"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 )
 
-func Restore(path string, recipe Recipe, password []byte, pr chan<- ProgressReport) error {
-	return RestoreSelected(path, recipe, password, pr, nil)
+// Restores only the selected names from the backup, sending progress reports
+// to pr and closing it when done. If names is empty, it behaves like a full
+// restore. It is a thin wrapper around Restore, with the default number of
+// jobs.
+func RestoreSelected(path string, recipe Recipe, password []byte, pr chan<- ProgressReport, names []string) error {
+	if pr != nil {
+		defer close(pr)
+	}
+
+	_, err := Restore(context.Background(), Options{
+		Path:     path,
+		Recipe:   recipe,
+		Names:    names,
+		Password: func() ([]byte, error) { return password, nil },
+		Progress: sendTo(pr),
+	})
+	return err
 }
 
-// Restores only the selected names from the backup. If names is empty, it
-// behaves like a full restore.
-func RestoreSelected(path string, recipe Recipe, password []byte, pr chan<- ProgressReport, names []string) error {
-	selectedRecipe, err := filterRecipeByNames(recipe, names)
+// Restores a plain backup. Entries with Encrypt set are decrypted with
+// password.
+func restorePlain(ctx context.Context, backupFolder string, recipe Recipe, password []byte, pr chan<- ProgressReport, jobs int, conflict string) error {
+	defer close(pr)
+
+	if recipe.hasEncryptedEntries() && password == nil {
+		return errors.New("the recipe has encrypted entries, but no password was given")
+	}
+
+	homePath, err := os.UserHomeDir()
 	if err != nil {
 		return err
 	}
 
-	backupPath, err := filepath.Abs(filepath.Join(path, "dbkp"))
-	if err != nil {
+	// Tells entries that stored nothing from missing ones.
+	manifest, err := readManifest(backupFolder)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
 		return err
 	}
 
-	if password != nil {
-		return restoreEncrypt(backupPath, selectedRecipe, password, pr)
+	stepsLen := uint64(len(recipe.Files) + len(recipe.Commands) + len(recipe.Packages))
+	tracker := newProgressTracker(pr, stepsLen)
+	tasks := []task{}
+
+	for _, file := range recipe.Files {
+		tracker.scan(file.Name, func() (uint64, error) {
+			backupPath := filepath.Join(backupFolder, file.Name)
+			if _, err := os.Lstat(backupPath); errors.Is(err, fs.ErrNotExist) && manifest.storedNothing(file.Name) {
+				return 0, nil
+			}
+
+			if file.Encrypt {
+				info, err := os.Stat(backupPath)
+				if err != nil {
+					return 0, err
+				}
+				return uint64(info.Size()), nil
+			}
+
+			filter, err := newPathFilter(file)
+			if err != nil {
+				return 0, err
+			}
+
+			return measureFileOrFolder(backupPath, filter)
+		})
+
+		tasks = append(tasks, task{name: file.Name, path: file.Path, phase: PhaseCopying, run: func(count uint64) error {
+			path := file.Path
+			if strings.HasPrefix(path, "~/") {
+				path = filepath.Join(homePath, path[2:])
+			}
+
+			backupPath := filepath.Join(backupFolder, file.Name)
+
+			_, err := os.Lstat(backupPath)
+			if errors.Is(err, fs.ErrNotExist) && manifest.storedNothing(file.Name) {
+				tracker.send(ProgressReport{Count: count, Name: file.Name, Message: "nothing was backed up"})
+				return nil
+			} else if err != nil {
+				return err
+			}
+
+			filter, err := newPathFilter(file)
+			if err != nil {
+				return err
+			}
+			filter = filter.reportingTo(file.Name, skipReporter(pr, count, stepsLen, file.Name))
+			filter = filter.countingTo(tracker.copied(count, file.Name)).cancelledBy(ctx).resolvingConflicts(conflict)
+
+			if file.Encrypt {
+				tracker.send(ProgressReport{Count: count, Name: file.Name, Phase: PhaseDecrypting})
+				data, err := readBlob(backupPath, password)
+				if err != nil {
+					return err
+				}
+
+				subtar := Tarball{}
+				subtar.Buffer.Write(data)
+				return subtar.unpackInto(file.Name, path, filter)
+			}
+
+			return copyFileOrFolder(backupPath, path, filter)
+		}})
+	}
+
+	for i, command := range recipe.Commands {
+		tasks = append(tasks, task{name: command.Name, serial: command.Serial || !command.Parallel, wait: i == 0, phase: PhaseRunning, run: func(count uint64) error {
+			backupPath := filepath.Join(backupFolder, command.Name)
+			data, err := readFile(backupPath)
+			if failure := command.unsavedFailure(err, manifest); failure != nil {
+				reportFailure(pr, count, stepsLen, failure)
+				return nil
+			} else if err != nil {
+				return err
+			}
+
+			if command.Encrypt {
+				data, err = decryptBlob(password, data)
+				if err != nil {
+					return err
+				}
+			}
+
+			return restoreCommand(ctx, command, bytes.NewBuffer(data), pr, count, stepsLen)
+		}})
+	}
+
+	for i, set := range recipe.Packages {
+		tasks = append(tasks, task{name: set.Name, serial: set.Serial || !set.Parallel, wait: i == 0 && len(recipe.Commands) == 0, phase: PhaseRunning, run: func(count uint64) error {
+			saved, err := savedPackages(backupFolder, nil, set)
+			if err != nil {
+				return err
+			}
+
+			return restorePackages(ctx, set, saved, pr, count, stepsLen)
+		}})
 	}
 
-	return restorePlain(backupPath, selectedRecipe, pr)
+	return runTasks(ctx, tasks, jobs, tracker)
 }
 
-func restorePlain(backupFolder string, recipe Recipe, pr chan<- ProgressReport) error {
+func restoreEncrypt(ctx context.Context, backupFile string, recipe Recipe, password []byte, pr chan<- ProgressReport, jobs int, conflict string) error {
 	defer close(pr)
 
-	homePath, err := os.UserHomeDir()
+	stepsLen := uint64(len(recipe.Files) + len(recipe.Commands) + len(recipe.Packages))
+	tracker := newProgressTracker(pr, stepsLen)
+
+	tracker.send(ProgressReport{Phase: PhaseDecrypting})
+	tar, err := loadTarball(backupFile, password, recipe)
 	if err != nil {
 		return err
 	}
 
-	stepsLen := uint64(len(recipe.Files) + len(recipe.Commands))
-
-	for i, file := range recipe.Files {
-		path := file.Path
-		if strings.HasPrefix(path, "~/") {
-			path = filepath.Join(homePath, path[2:])
-		}
-
-		if pr != nil {
-			pr <- ProgressReport{uint64(i), stepsLen, file.Name}
-		}
-		backupPath := filepath.Join(backupFolder, file.Name)
-
-		_, err := os.Lstat(backupPath)
-		if err != nil {
-			return err
-		}
+	homePath, err := os.UserHomeDir()
+	if err != nil {
+		return err
+	}
 
-		if err := copyFileOrFolder(backupPath, path, file); err != nil {
+	// Tells commands that saved nothing from missing ones.
+	manifest := Manifest{}
+	if data, err := tar.readFile(manifestName); err == nil {
+		if manifest, err = parseManifest(data.Bytes()); err != nil {
 			return err
 		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
 	}
 
-	shellPath, err := exec.LookPath("sh")
-	if err != nil {
-		return err
+	tasks := []task{}
+
+	for _, file := range recipe.Files {
+		tracker.scan(file.Name, func() (uint64, error) {
+			subtar, err := tar.readFile(file.Name)
+			if err != nil {
+				return 0, err
+			}
+			return Tarball{Buffer: subtar}.contentSize()
+		})
+
+		tasks = append(tasks, task{name: file.Name, path: file.Path, phase: PhaseCopying, run: func(count uint64) error {
+			path := file.Path
+			if strings.HasPrefix(path, "~/") {
+				path = filepath.Join(homePath, path[2:])
+			}
+
+			subtarbuffer, err := tar.readFile(file.Name)
+			subtar := Tarball{Buffer: subtarbuffer}
+			if err != nil {
+				return err
+			}
+
+			filter, err := newPathFilter(file)
+			if err != nil {
+				return err
+			}
+			filter = filter.reportingTo(file.Name, skipReporter(pr, count, stepsLen, file.Name))
+			filter = filter.countingTo(tracker.copied(count, file.Name)).cancelledBy(ctx).resolvingConflicts(conflict)
+
+			return subtar.unpackInto(file.Name, path, filter)
+		}})
 	}
 
 	for i, command := range recipe.Commands {
-		if pr != nil {
-			pr <- ProgressReport{uint64(i + len(recipe.Files)), stepsLen, command.Name}
-		}
-
-		backupPath := filepath.Join(backupFolder, command.Name)
-		data, err := readFile(backupPath)
-		if err != nil {
-			return err
-		}
+		tasks = append(tasks, task{name: command.Name, serial: command.Serial || !command.Parallel, wait: i == 0, phase: PhaseRunning, run: func(count uint64) error {
+			stdin, err := tar.readFile(command.Name)
+			if failure := command.unsavedFailure(err, manifest); failure != nil {
+				reportFailure(pr, count, stepsLen, failure)
+				return nil
+			} else if err != nil {
+				return err
+			}
+
+			return restoreCommand(ctx, command, &stdin, pr, count, stepsLen)
+		}})
+	}
 
-		var stderr bytes.Buffer
-		stdin := bytes.NewBuffer(data)
+	for i, set := range recipe.Packages {
+		tasks = append(tasks, task{name: set.Name, serial: set.Serial || !set.Parallel, wait: i == 0 && len(recipe.Commands) == 0, phase: PhaseRunning, run: func(count uint64) error {
+			saved, err := savedPackages(backupFile, &tar, set)
+			if err != nil {
+				return err
+			}
 
-		if err := executeCommandInShell(shellPath, command.Restore, stdin, nil, &stderr); err != nil {
-			return errors.Join(err, fmt.Errorf("Command failed with error\n: %s", stderr.String()))
-		}
+			return restorePackages(ctx, set, saved, pr, count, stepsLen)
+		}})
 	}
 
-	return nil
+	return runTasks(ctx, tasks, jobs, tracker)
 }
 
-func restoreEncrypt(backupFile string, recipe Recipe, password []byte, pr chan<- ProgressReport) error {
-	defer close(pr)
+// Returns the failure to report instead of restoring command, if reading its
+// saved output failed with err because its Backup failed and OnFailure let the
+// backup go on without it.
+func (command Command) unsavedFailure(err error, manifest Manifest) *CommandFailure {
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
 
-	tar, err := loadTarball(backupFile, password, recipe)
-	if err != nil {
-		return err
+	entry := manifest.entry(command.Name)
+	skipped := entry != nil && entry.Skipped
+	if !skipped && command.OnFailure != OnFailureWarn && command.OnFailure != OnFailureSkip {
+		return nil
 	}
 
-	homePath, err := os.UserHomeDir()
-	if err != nil {
-		return err
+	message := "its backup saved nothing, it was not restored"
+	if skipped && entry.ExitCode != nil {
+		message = fmt.Sprintf("its backup failed with exit code %d and saved nothing, it was not restored", *entry.ExitCode)
 	}
 
-	stepsLen := uint64(len(recipe.Files) + len(recipe.Commands))
+	return &CommandFailure{Entry: command.Name, ExitCode: -1, Error: message}
+}
 
-	for i, file := range recipe.Files {
-		path := file.Path
-		if strings.HasPrefix(path, "~/") {
-			path = filepath.Join(homePath, path[2:])
+// Runs the Restore of command, which is step count of total, feeding it the
+// saved output in data. If the command has a Check, only the lines missing
+// from the current state are fed, and nothing is run if there are none. A
+// failing Check is reported as a warning and every saved line is fed.
+func restoreCommand(ctx context.Context, command Command, data *bytes.Buffer, pr chan<- ProgressReport, count uint64, total uint64) error {
+	if command.Check != "" {
+		pending, upToDate, err := command.pendingInput(ctx, data.Bytes())
+		if ctx.Err() != nil {
+			return ctx.Err()
 		}
 
-		if pr != nil {
-			pr <- ProgressReport{uint64(i + 1), stepsLen, file.Name}
+		if err != nil {
+			reportFailure(pr, count, total, &CommandFailure{
+				Entry:    command.Name,
+				ExitCode: exitCode(err),
+				Error:    fmt.Sprintf("its Check failed, every saved line is restored: %s", err),
+			})
 		}
 
-		subtarbuffer, err := tar.readFile(file.Name)
-		subtar := Tarball{Buffer: subtarbuffer}
-		if err != nil {
-			return err
+		if upToDate {
+			if pr != nil {
+				pr <- ProgressReport{Count: count, Total: total, Name: command.Name, Message: "already up to date"}
+			}
+			return nil
 		}
 
-		subtar.unpackInto(file.Name, path)
+		data = bytes.NewBuffer(pending)
 	}
 
-	shellPath, err := exec.LookPath("sh")
+	var stderr bytes.Buffer
+	result, err := executeRestore(ctx, command, data, &stderr)
+	reportResult(pr, count, total, result)
+
+	failure, err := command.checkFailure(err, &stderr)
 	if err != nil {
 		return err
 	}
 
-	for i, command := range recipe.Commands {
-		if pr != nil {
-			pr <- ProgressReport{uint64(i + len(recipe.Files) + 1), stepsLen, command.Name}
-		}
-
-		var stderr bytes.Buffer
-		stdin, err := tar.readFile(command.Name)
-		if err != nil {
-			return err
-		}
-
-		if err := executeCommandInShell(shellPath, command.Restore, &stdin, nil, &stderr); err != nil {
-			return errors.Join(err, fmt.Errorf("Command failed with error\n: %s", stderr.String()))
-		}
+	if failure != nil {
+		reportFailure(pr, count, total, failure)
 	}
 
 	return nil
@@ -0,0 +1,292 @@
+package dbkp
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Values accepted in Recipe.SecretPolicy.
+const (
+	SecretPolicyWarn = "warn" // Report possible secrets and write the backup anyway. The default.
+	SecretPolicyFail = "fail" // Refuse to write a backup containing possible secrets.
+	SecretPolicyOff  = "off"  // Do not scan for secrets.
+)
+
+// Prefix of the AllowSecrets entries that disable a detector instead of
+// allowing a path.
+const allowRulePrefix = "rule:"
+
+// A possible secret found in a file or command output of an unencrypted
+// backup.
+type SecretFinding struct {
+	Entry string // The Name of the File or Command entry.
+	Path  string // The path of the file relative to the entry's Path, or the entry Name if it is a single file or Command.
+	Line  int    // The line number, starting at 1.
+	Rule  string // The name of the detector that matched.
+	Match string // The matched text, redacted.
+}
+
+type secretRule struct {
+	name string
+	re   *regexp.Regexp
+}
+
+// Detectors for well known secret formats. High entropy strings are detected
+// separately, see highEntropyRule.
+var secretRules = []secretRule{
+	{"private-key", regexp.MustCompile(`-----BEGIN ((RSA|DSA|EC|OPENSSH|PGP|ENCRYPTED) )?PRIVATE KEY( BLOCK)?-----`)},
+	{"aws-access-key", regexp.MustCompile(`\b(AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{"github-token", regexp.MustCompile(`\b(gh[pousr]_[A-Za-z0-9]{36,}|github_pat_[A-Za-z0-9_]{22,})\b`)},
+	{"gitlab-token", regexp.MustCompile(`\bglpat-[A-Za-z0-9_-]{20,}`)},
+	{"slack-token", regexp.MustCompile(`\bxox[abprs]-[A-Za-z0-9-]{10,}`)},
+	{"stripe-key", regexp.MustCompile(`\b[rs]k_live_[A-Za-z0-9]{20,}\b`)},
+	{"google-api-key", regexp.MustCompile(`\bAIza[0-9A-Za-z_-]{35}\b`)},
+	{"api-key", regexp.MustCompile(`\bsk-[A-Za-z0-9_-]{32,}`)},
+	{"jwt", regexp.MustCompile(`\beyJ[A-Za-z0-9_-]{10,}\.eyJ[A-Za-z0-9_-]{10,}\.[A-Za-z0-9_-]{10,}`)},
+}
+
+const highEntropyRule = "high-entropy"
+
+var (
+	entropyCandidate = regexp.MustCompile(`[A-Za-z0-9+/=_-]{24,}`)
+	hexCandidate     = regexp.MustCompile(`^[0-9a-fA-F]+$`)
+	secretKeyword    = regexp.MustCompile(`(?i)(secret|token|passw(or)?d|api_?key|auth|credential|private)`)
+)
+
+// Scans data for secrets, skipping the paths and detectors allowed for the
+// entry being scanned.
+type secretScanner struct {
+	entry    string
+	allow    []string
+	disabled map[string]struct{}
+}
+
+func newSecretScanner(entry string, allow []string) (secretScanner, error) {
+	scanner := secretScanner{entry: entry, disabled: map[string]struct{}{}}
+
+	for _, entry := range allow {
+		if rule, ok := strings.CutPrefix(entry, allowRulePrefix); ok {
+			scanner.disabled[rule] = struct{}{}
+			continue
+		}
+
+		pattern := strings.Join(splitSegments(filepath.ToSlash(entry)), "/")
+		if err := validateGlob(pattern); err != nil {
+			return scanner, fmt.Errorf("invalid AllowSecrets pattern %q: %w", entry, err)
+		}
+		scanner.allow = append(scanner.allow, pattern)
+	}
+
+	return scanner, nil
+}
+
+// Reports whether the file rel is allowed to contain secrets.
+func (scanner secretScanner) allowed(rel string) bool {
+	segments := splitSegments(rel)
+	for _, pattern := range scanner.allow {
+		for i := 1; i <= len(segments); i++ {
+			if matchGlob(pattern, strings.Join(segments[:i], "/")) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Scans the contents of the file rel. Binary data is not scanned.
+func (scanner secretScanner) scan(rel string, data []byte) []SecretFinding {
+	if scanner.allowed(rel) {
+		return nil
+	}
+
+	if bytes.IndexByte(data[:min(len(data), 8000)], 0) != -1 {
+		return nil
+	}
+
+	findings := []SecretFinding{}
+	for i, line := range strings.Split(string(data), "\n") {
+		matched := false
+		for _, rule := range secretRules {
+			if _, ok := scanner.disabled[rule.name]; ok {
+				continue
+			}
+			if match := rule.re.FindString(line); match != "" {
+				findings = append(findings, scanner.finding(rel, i+1, rule.name, match))
+				matched = true
+			}
+		}
+
+		if _, ok := scanner.disabled[highEntropyRule]; ok || matched {
+			continue
+		}
+
+		for _, candidate := range entropyCandidate.FindAllString(line, -1) {
+			if looksLikeSecret(candidate, line) {
+				findings = append(findings, scanner.finding(rel, i+1, highEntropyRule, candidate))
+				break
+			}
+		}
+	}
+
+	return findings
+}
+
+// Scans the file or folder at root, which is the backed up copy of the entry.
+func (scanner secretScanner) scanPath(root string) ([]SecretFinding, error) {
+	findings := []SecretFinding{}
+
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			rel = filepath.Base(root)
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		findings = append(findings, scanner.scan(filepath.ToSlash(rel), data)...)
+		return nil
+	})
+
+	return findings, err
+}
+
+func (scanner secretScanner) finding(rel string, line int, rule string, match string) SecretFinding {
+	return SecretFinding{Entry: scanner.entry, Path: rel, Line: line, Rule: rule, Match: redact(match)}
+}
+
+// Reports whether candidate, found in line, is random enough to be a secret.
+// Hexadecimal strings (hashes, commit ids) are only reported next to a word
+// like "token" or "password".
+func looksLikeSecret(candidate string, line string) bool {
+	if hexCandidate.MatchString(candidate) {
+		return len(candidate) >= 32 && shannonEntropy(candidate) >= 3.5 && secretKeyword.MatchString(line)
+	}
+
+	hasDigit := strings.ContainsAny(candidate, "0123456789")
+	hasUpper := strings.ContainsAny(candidate, "ABCDEFGHIJKLMNOPQRSTUVWXYZ")
+	hasLower := strings.ContainsAny(candidate, "abcdefghijklmnopqrstuvwxyz")
+
+	return hasDigit && hasUpper && hasLower && shannonEntropy(candidate) >= 4.5
+}
+
+func shannonEntropy(value string) float64 {
+	counts := map[rune]int{}
+	for _, r := range value {
+		counts[r]++
+	}
+
+	entropy := 0.0
+	length := float64(len(value))
+	for _, count := range counts {
+		p := float64(count) / length
+		entropy -= p * math.Log2(p)
+	}
+
+	return entropy
+}
+
+// Keeps only the first characters of a secret, so it is not printed.
+func redact(value string) string {
+	if len(value) <= 8 {
+		return strings.Repeat("*", len(value))
+	}
+	return fmt.Sprintf("%s… (%d chars)", value[:6], len(value))
+}
+
+// Formats findings one per line, for error messages and reports.
+func formatSecretFindings(findings []SecretFinding) string {
+	lines := make([]string, 0, len(findings))
+	for _, finding := range findings {
+		path := finding.Entry
+		if finding.Path != "" && finding.Path != finding.Entry {
+			path = finding.Entry + "/" + finding.Path
+		}
+		lines = append(lines, fmt.Sprintf("%s:%d: %s %s", path, finding.Line, finding.Rule, finding.Match))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Scans the plain backup of recipe, in the folder of the recipe, path, or in
+// the Destinations of the recipe and its entries, for secrets. If names is non-empty, only
+// those entries are scanned. The AllowSecrets of each entry are respected, but
+// not the SecretPolicy.
+func ScanBackup(path string, recipe Recipe, names []string) ([]SecretFinding, error) {
+	selected, err := filterRecipeByNames(recipe, names)
+	if err != nil {
+		return nil, err
+	}
+
+	if recipe.Encrypted() {
+		return nil, fmt.Errorf("the backup is encrypted, there is nothing to scan")
+	}
+
+	findings := []SecretFinding{}
+
+	for _, file := range selected.Files {
+		if file.Encrypt {
+			continue
+		}
+
+		scanner, err := newSecretScanner(file.Name, file.AllowSecrets)
+		if err != nil {
+			return nil, err
+		}
+
+		folder, err := recipe.destinationPath(path, file.Destination)
+		if err != nil {
+			return nil, err
+		}
+
+		found, err := scanner.scanPath(filepath.Join(folder, "dbkp", file.Name))
+		if err != nil {
+			return nil, err
+		}
+
+		findings = append(findings, found...)
+	}
+
+	for _, command := range selected.Commands {
+		if command.Encrypt {
+			continue
+		}
+
+		scanner, err := newSecretScanner(command.Name, command.AllowSecrets)
+		if err != nil {
+			return nil, err
+		}
+
+		folder, err := recipe.destinationPath(path, command.Destination)
+		if err != nil {
+			return nil, err
+		}
+
+		data, err := os.ReadFile(filepath.Join(folder, "dbkp", command.Name))
+		if err != nil {
+			return nil, err
+		}
+
+		findings = append(findings, scanner.scan(command.Name, data)...)
+	}
+
+	return findings, nil
+}
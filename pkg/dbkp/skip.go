@@ -0,0 +1,236 @@
+package dbkp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Types accepted in SkipRules.SkipTypes. Sockets, fifos and devices are never
+// backed up, listing them only makes it explicit.
+const (
+	SkipTypeSocket = "socket"
+	SkipTypeFifo   = "fifo"
+	SkipTypeDevice = "device"
+	SkipTypeBinary = "binary" // Files whose first bytes contain a NUL byte, as git detects them.
+)
+
+// Size, age and type based exclusion rules for files inside backed up folders.
+// They can be set for the whole Recipe and overridden in each File. Sizes
+// accept the suffixes B, K, M, G and T (optionally followed by B or iB, all
+// powers of 1024) and ages accept Go durations plus the d (day) and w (week)
+// units.
+type SkipRules struct {
+	MaxFileSize      string   `toml:",omitempty"` // Files larger than this are skipped, e.g.: "10MB".
+	MaxEntrySize     string   `toml:",omitempty"` // Once this many bytes were backed up for the File, the remaining files are skipped.
+	ExcludeOlderThan string   `toml:",omitempty"` // Files not modified for longer than this are skipped, e.g.: "30d".
+	SkipTypes        []string `toml:",omitempty"` // Types of files to skip, see the SkipType constants.
+}
+
+// A file that was not backed up or restored, and why.
+type SkippedFile struct {
+	Entry  string // The Name of the File or Command entry.
+	Path   string // The path of the file, relative to the entry's Path.
+	Reason string // A human readable reason.
+}
+
+// Returns rules with every unset field taken from defaults.
+func (rules SkipRules) inherit(defaults SkipRules) SkipRules {
+	if rules.MaxFileSize == "" {
+		rules.MaxFileSize = defaults.MaxFileSize
+	}
+	if rules.MaxEntrySize == "" {
+		rules.MaxEntrySize = defaults.MaxEntrySize
+	}
+	if rules.ExcludeOlderThan == "" {
+		rules.ExcludeOlderThan = defaults.ExcludeOlderThan
+	}
+	if len(rules.SkipTypes) == 0 {
+		rules.SkipTypes = defaults.SkipTypes
+	}
+	return rules
+}
+
+// The parsed form of SkipRules, with the state needed to enforce
+// MaxEntrySize.
+type fileLimits struct {
+	maxFileSize  int64
+	maxEntrySize int64
+	olderThan    time.Time
+	skipBinary   bool
+	entrySize    int64
+}
+
+func newFileLimits(rules SkipRules) (*fileLimits, error) {
+	limits := &fileLimits{}
+
+	var err error
+	if rules.MaxFileSize != "" {
+		if limits.maxFileSize, err = parseSize(rules.MaxFileSize); err != nil {
+			return nil, fmt.Errorf("invalid MaxFileSize: %w", err)
+		}
+	}
+
+	if rules.MaxEntrySize != "" {
+		if limits.maxEntrySize, err = parseSize(rules.MaxEntrySize); err != nil {
+			return nil, fmt.Errorf("invalid MaxEntrySize: %w", err)
+		}
+	}
+
+	if rules.ExcludeOlderThan != "" {
+		age, err := parseAge(rules.ExcludeOlderThan)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ExcludeOlderThan: %w", err)
+		}
+		limits.olderThan = time.Now().Add(-age)
+	}
+
+	for _, kind := range rules.SkipTypes {
+		switch kind {
+		case SkipTypeSocket, SkipTypeFifo, SkipTypeDevice:
+		case SkipTypeBinary:
+			limits.skipBinary = true
+		default:
+			return nil, fmt.Errorf("unknown skip type %q", kind)
+		}
+	}
+
+	return limits, nil
+}
+
+// Checks the regular file at path against the limits. Returns the reason to
+// skip it, or an empty string if it should be backed up, in which case its
+// size is added to the entry size.
+func (limits *fileLimits) check(path string, info fs.FileInfo) (string, error) {
+	if limits == nil {
+		return "", nil
+	}
+
+	size := info.Size()
+	if limits.maxFileSize > 0 && size > limits.maxFileSize {
+		return fmt.Sprintf("larger than MaxFileSize (%s)", formatSize(size)), nil
+	}
+
+	if !limits.olderThan.IsZero() && info.ModTime().Before(limits.olderThan) {
+		return fmt.Sprintf("older than ExcludeOlderThan (modified %s)", info.ModTime().Format(time.DateOnly)), nil
+	}
+
+	if limits.skipBinary {
+		binary, err := isBinaryFile(path)
+		if err != nil {
+			return "", err
+		}
+		if binary {
+			return "binary file", nil
+		}
+	}
+
+	if limits.maxEntrySize > 0 && limits.entrySize+size > limits.maxEntrySize {
+		return "entry reached MaxEntrySize", nil
+	}
+
+	limits.entrySize += size
+	return "", nil
+}
+
+// Describes the type of a file that cannot be backed up.
+func specialFileReason(mode fs.FileMode) string {
+	switch {
+	case mode&fs.ModeSocket != 0:
+		return SkipTypeSocket
+	case mode&fs.ModeNamedPipe != 0:
+		return SkipTypeFifo
+	case mode&fs.ModeDevice != 0:
+		return SkipTypeDevice
+	default:
+		return "unsupported file type"
+	}
+}
+
+// Reports whether the file looks binary, using the same heuristic as git: a
+// NUL byte in the first 8000 bytes.
+func isBinaryFile(path string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	buffer := make([]byte, 8000)
+	n, err := file.Read(buffer)
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+
+	return bytes.IndexByte(buffer[:n], 0) != -1, nil
+}
+
+var (
+	sizeUnits   = []string{"B", "K", "M", "G", "T"}
+	sizePattern = regexp.MustCompile(`^(?i)([0-9]*\.?[0-9]+)\s*([KMGT]?)(I?B)?$`)
+)
+
+// Parses sizes like "512", "10MB", "1.5GiB" or "100k".
+func parseSize(value string) (int64, error) {
+	match := sizePattern.FindStringSubmatch(strings.TrimSpace(value))
+	if match == nil {
+		return 0, fmt.Errorf("cannot parse size %q", value)
+	}
+
+	number, err := strconv.ParseFloat(match[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse size %q", value)
+	}
+
+	if match[2] != "" {
+		for range slices.Index(sizeUnits, strings.ToUpper(match[2])) {
+			number *= 1024
+		}
+	}
+
+	return int64(number), nil
+}
+
+// Formats a size in bytes using the largest unit that keeps it above 1.
+func formatSize(size int64) string {
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < len(sizeUnits)-1 {
+		value /= 1024
+		unit++
+	}
+
+	if unit == 0 {
+		return fmt.Sprintf("%dB", size)
+	}
+
+	return fmt.Sprintf("%.1f%siB", value, sizeUnits[unit])
+}
+
+// Parses a Go duration, also accepting days ("30d") and weeks ("2w").
+func parseAge(value string) (time.Duration, error) {
+	s := strings.TrimSpace(value)
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if number, ok := strings.CutSuffix(s, suffix); ok {
+			n, err := strconv.ParseFloat(number, 64)
+			if err != nil || n < 0 {
+				return 0, fmt.Errorf("cannot parse age %q", value)
+			}
+			return time.Duration(n * float64(unit)), nil
+		}
+	}
+
+	age, err := time.ParseDuration(s)
+	if err != nil || age < 0 {
+		return 0, fmt.Errorf("cannot parse age %q", value)
+	}
+
+	return age, nil
+}
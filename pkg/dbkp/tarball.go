@@ -3,6 +3,8 @@ package dbkp
 import (
 	"archive/tar"
 	"bytes"
+	"crypto/sha256"
+	"fmt"
 	"io"
 	"io/fs"
 	"os"
@@ -40,60 +42,67 @@ func (tarball *Tarball) closeWrite() error {
 }
 
 // Add the file/folder present in path to a file/folder named name in the
-// tarball, respecting the restrictions in file.
-func (tarball Tarball) addFileOrFolder(name string, path string, file File) error {
+// tarball, respecting the restrictions in filter.
+func (tarball Tarball) addFileOrFolder(name string, path string, filter pathFilter) error {
 	fileinfo, err := os.Lstat(path)
 	if err != nil {
 		return err
 	}
 
-	filter, err := newPathFilter(file)
-	if err != nil {
-		return err
-	}
-
-	if fileinfo.IsDir() {
-		return tarball.addFolderWithFilter(name, path, "", filter)
-	} else if fileinfo.Mode().IsRegular() {
-		contents, err := readFile(path)
+	if fileinfo.Mode()&os.ModeSymlink == os.ModeSymlink {
+		realpath, err := filepath.EvalSymlinks(path)
 		if err != nil {
+			filter.skipped("", "broken symlink")
 			return nil
 		}
 
-		return tarball.addFile(name, contents)
-	} else if fileinfo.Mode()&os.ModeSymlink == os.ModeSymlink {
-		realpath, err := filepath.EvalSymlinks(path)
+		fileinfo, err = os.Stat(realpath)
 		if err != nil {
+			filter.skipped("", "broken symlink")
 			return nil
 		}
 
-		fileinfo, err = os.Stat(realpath)
+		path = realpath
+	}
+
+	if fileinfo.IsDir() {
+		return tarball.addFolderWithFilter(name, path, "", filter)
+	} else if fileinfo.Mode().IsRegular() {
+		if skip, err := filter.skipsFile(path, "", fileinfo); err != nil || skip {
+			return err
+		}
+
+		contents, err := readFile(path)
 		if err != nil {
 			return nil
 		}
 
-		if fileinfo.IsDir() {
-			return tarball.addFolderWithFilter(name, realpath, "", filter)
-		} else if fileinfo.Mode().IsRegular() {
-			contents, err := readFile(path)
-			if err != nil {
-				return nil
-			}
-
-			return tarball.addFile(name, contents)
+		if err := tarball.addFileWithMode(name, contents, fileinfo.Mode()); err != nil {
+			return err
 		}
+
+		sum := sha256.Sum256(contents)
+		filter.copied("", fileinfo, sum[:])
+		return nil
 	}
 
+	filter.skipped("", specialFileReason(fileinfo.Mode()))
 	return nil
 }
 
 // Adds contents as a file to the tarball as name.
 func (tarball Tarball) addFile(name string, contents []byte) error {
+	return tarball.addFileWithMode(name, contents, 0600)
+}
+
+// Adds contents as a file to the tarball as name, restored with the
+// permissions in mode.
+func (tarball Tarball) addFileWithMode(name string, contents []byte, mode fs.FileMode) error {
 	tw := tarball.Writter
 
 	hdr := &tar.Header{
 		Name: name,
-		Mode: 0600,
+		Mode: int64(mode.Perm()),
 		Size: int64(len(contents)),
 	}
 
@@ -115,8 +124,12 @@ func (tarball Tarball) addFolderWithFilter(name string, path string, prefix stri
 			return err
 		}
 
+		if err := filter.cancelled(); err != nil {
+			return err
+		}
+
 		if p == "." {
-			return nil
+			return filter.loadIgnoreFile(path, prefix)
 		}
 
 		srcpath := filepath.Join(path, p)
@@ -141,42 +154,55 @@ func (tarball Tarball) addFolderWithFilter(name string, path string, prefix stri
 		}
 
 		if fileinfo.IsDir() {
-			return nil
-		} else if fileinfo.Mode().IsRegular() {
-			contents, err := readFile(srcpath)
-			if err != nil {
-				return err
-			}
+			return filter.loadIgnoreFile(srcpath, rel)
+		}
 
-			return tarball.addFile(dstpath, contents)
-		} else if fileinfo.Mode()&os.ModeSymlink == os.ModeSymlink {
+		if fileinfo.Mode()&os.ModeSymlink == os.ModeSymlink {
 			realpath, err := filepath.EvalSymlinks(srcpath)
 			if err != nil {
+				filter.skipped(rel, "broken symlink")
 				return nil
 			}
 
-			fileinfo, err := os.Stat(realpath)
+			fileinfo, err = os.Stat(realpath)
 			if err != nil {
+				filter.skipped(rel, "broken symlink")
 				return nil
 			}
 
 			if fileinfo.IsDir() {
 				return tarball.addFolderWithFilter(dstpath, realpath, rel, filter)
-			} else if fileinfo.Mode().IsRegular() {
-				contents, err := readFile(realpath)
-				if err != nil {
-					return err
-				}
-
-				return tarball.addFile(dstpath, contents)
 			}
+
+			srcpath = realpath
+		}
+
+		if !fileinfo.Mode().IsRegular() {
+			filter.skipped(rel, specialFileReason(fileinfo.Mode()))
+			return nil
+		}
+
+		if skip, err := filter.skipsFile(srcpath, rel, fileinfo); err != nil || skip {
+			return err
 		}
 
+		contents, err := readFile(srcpath)
+		if err != nil {
+			return err
+		}
+
+		if err := tarball.addFileWithMode(dstpath, contents, fileinfo.Mode()); err != nil {
+			return err
+		}
+
+		sum := sha256.Sum256(contents)
+		filter.copied(rel, fileinfo, sum[:])
 		return nil
 	})
 }
 
 // Reads a file from the tarball, returning its contents in a bytes.Buffer.
+// Returns an error wrapping fs.ErrNotExist if there is no such file.
 func (tarball Tarball) readFile(name string) (bytes.Buffer, error) {
 	tr := tar.NewReader(&tarball.Buffer)
 	var buffer bytes.Buffer
@@ -186,55 +212,128 @@ func (tarball Tarball) readFile(name string) (bytes.Buffer, error) {
 		if err == io.EOF {
 			break // End of archive
 		} else if err != nil {
-			return buffer, err
+			return buffer, corruptArchive(err)
 		}
 
 		if hdr.Name == name {
 			if _, err := io.Copy(&buffer, tr); err != nil {
-				return buffer, err
+				return buffer, corruptArchive(err)
 			}
 
 			return buffer, nil
 		}
 	}
 
-	return buffer, nil
+	return buffer, fmt.Errorf("%s: %w", name, fs.ErrNotExist)
 }
 
 // Saves all the contents of a tarball into path. name is removed from the
 // beginning of the path (name is usually File.Name, which is was used to add
-// the file/folder to the tarball in the first place).
-func (tarball Tarball) unpackInto(name string, path string) error {
+// the file/folder to the tarball in the first place). Members skipped by
+// filter are not written. Members that are not regular files, or whose path
+// is not inside name, are refused, so nothing is written outside of path and
+// no symlink can be planted to redirect later members.
+func (tarball Tarball) unpackInto(name string, path string, filter pathFilter) error {
 	tr := tar.NewReader(&tarball.Buffer)
 
 	for {
 		var buffer bytes.Buffer
 
+		if err := filter.cancelled(); err != nil {
+			return err
+		}
+
 		hdr, err := tr.Next()
 		if err == io.EOF {
 			break // End of archive
 		} else if err != nil {
+			return corruptArchive(err)
+		}
+
+		if hdr.Typeflag != tar.TypeReg {
+			return corruptArchive(fmt.Errorf("%s: not a regular file", hdr.Name))
+		}
+
+		rel, err := memberPath(name, hdr.Name)
+		if err != nil {
 			return err
 		}
 
 		if _, err := io.Copy(&buffer, tr); err != nil {
-			return err
+			return corruptArchive(err)
 		}
 
-		dstpath := filepath.Join(path, strings.Replace(hdr.Name, name, "", 1))
+		if filter.skipsPath(rel) {
+			continue
+		}
+
+		dstpath := filepath.Join(path, rel)
 		dstdir := filepath.Dir(dstpath)
 		if err := os.MkdirAll(dstdir, os.ModeDir|os.ModePerm); err != nil {
 			return err
 		}
 
+		sum := func() ([]byte, error) {
+			sum := sha256.Sum256(buffer.Bytes())
+			return sum[:], nil
+		}
+
+		if skip, err := filter.resolveConflict(dstpath, rel, sum); err != nil || skip {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
 		if err := os.WriteFile(dstpath, buffer.Bytes(), 0600); err != nil {
 			return err
 		}
+
+		if err := os.Chmod(dstpath, hdr.FileInfo().Mode().Perm()); err != nil {
+			return err
+		}
+
+		filter.copied(rel, hdr.FileInfo(), nil)
 	}
 
 	return nil
 }
 
+// Returns the path of the member memberName of a tarball made for the entry
+// name, relative to the Path of the entry (empty if the entry is a single
+// file). Refuses members outside of name, absolute paths and paths going up
+// with "..".
+func memberPath(name string, memberName string) (string, error) {
+	rel, ok := strings.CutPrefix(memberName, name)
+	if !ok || (rel != "" && rel[0] != '/') {
+		return "", corruptArchive(fmt.Errorf("%s: not inside %s", memberName, name))
+	}
+
+	rel = strings.TrimPrefix(rel, "/")
+	if rel != "" && !filepath.IsLocal(filepath.FromSlash(rel)) {
+		return "", corruptArchive(fmt.Errorf("%s: unsafe path", memberName))
+	}
+
+	return rel, nil
+}
+
+// Returns the sum of the sizes of the files in the tarball.
+func (tarball Tarball) contentSize() (uint64, error) {
+	tr := tar.NewReader(&tarball.Buffer)
+	var size uint64
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return size, nil
+		} else if err != nil {
+			return size, corruptArchive(err)
+		}
+
+		size += uint64(hdr.Size)
+	}
+}
+
 // Decrypts and reads the tarball into memory.
 func loadTarball(path string, password []byte, recipe Recipe) (Tarball, error) {
 	tarball := Tarball{}
@@ -255,8 +354,9 @@ func loadTarball(path string, password []byte, recipe Recipe) (Tarball, error) {
 	return tarball, nil
 }
 
-// Writes the tarball contents to file, encrypted.
-func (tarball Tarball) writeToFile(path string, password []byte, recipe Recipe) error {
+// Writes the tarball contents to file, encrypted, and the new EncryptionSalt
+// to the recipe file in recipePath.
+func (tarball Tarball) writeToFile(path string, recipePath string, password []byte, recipe Recipe) error {
 	if err := tarball.Writter.Close(); err != nil {
 		return err
 	}
@@ -267,9 +367,8 @@ func (tarball Tarball) writeToFile(path string, password []byte, recipe Recipe)
 		return err
 	}
 
-	tomlPath := filepath.Join(filepath.Dir(path), "dbkp.toml")
 	recipe.EncryptionSalt = [2]string{keysalt, iv}
-	if err := recipe.WriteRecipe(tomlPath); err != nil {
+	if err := saveEncryptionSalt(recipePath, recipe); err != nil {
 		return err
 	}
 
@@ -279,6 +378,14 @@ func (tarball Tarball) writeToFile(path string, password []byte, recipe Recipe)
 // Copy existing tarball entries into dst, skipping any entry that belongs to
 // the excluded names.
 func (tarball Tarball) copyEntriesExcluding(dst *Tarball, excluded map[string]struct{}) error {
+	return tarball.copyEntries(dst, func(name string, contents []byte) (string, []byte, bool, error) {
+		return name, contents, !isExcludedEntry(name, excluded), nil
+	})
+}
+
+// Copy existing tarball entries into dst, passing each one through rewrite,
+// which returns its new name and contents, or false to skip it.
+func (tarball Tarball) copyEntries(dst *Tarball, rewrite func(name string, contents []byte) (string, []byte, bool, error)) error {
 	tr := tar.NewReader(&tarball.Buffer)
 	tw := dst.Writter
 
@@ -287,27 +394,30 @@ func (tarball Tarball) copyEntriesExcluding(dst *Tarball, excluded map[string]st
 		if err == io.EOF {
 			break
 		} else if err != nil {
-			return err
-		}
-
-		if isExcludedEntry(hdr.Name, excluded) {
-			continue
+			return corruptArchive(err)
 		}
 
 		var buffer bytes.Buffer
 		if _, err := io.Copy(&buffer, tr); err != nil {
+			return corruptArchive(err)
+		}
+
+		name, contents, keep, err := rewrite(hdr.Name, buffer.Bytes())
+		if err != nil {
 			return err
+		} else if !keep {
+			continue
 		}
 
 		newHdr := &tar.Header{
-			Name: hdr.Name,
+			Name: name,
 			Mode: hdr.Mode,
-			Size: int64(buffer.Len()),
+			Size: int64(len(contents)),
 		}
 		if err := tw.WriteHeader(newHdr); err != nil {
 			return err
 		}
-		if _, err := tw.Write(buffer.Bytes()); err != nil {
+		if _, err := tw.Write(contents); err != nil {
 			return err
 		}
 	}
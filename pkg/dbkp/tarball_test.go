@@ -0,0 +1,169 @@
+package dbkp
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A member of a tarball built by craftTarball.
+type craftedMember struct {
+	name     string
+	typeflag byte
+	contents string
+	linkname string
+}
+
+// Builds a tarball with members, as a crafted or corrupted backup could
+// contain them.
+func craftTarball(t testing.TB, members ...craftedMember) []byte {
+	var buffer bytes.Buffer
+	tw := tar.NewWriter(&buffer)
+
+	for _, member := range members {
+		hdr := &tar.Header{
+			Name:     member.name,
+			Typeflag: member.typeflag,
+			Mode:     0644,
+			Size:     int64(len(member.contents)),
+			Linkname: member.linkname,
+		}
+		if member.typeflag != tar.TypeReg {
+			hdr.Size = 0
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+
+		if hdr.Size > 0 {
+			if _, err := tw.Write([]byte(member.contents)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buffer.Bytes()
+}
+
+// Adds the tarball of a real folder and crafted tarballs trying to escape the
+// destination to the corpus of f.
+func addTarballSeeds(f *testing.F) {
+	src := f.TempDir()
+	if err := os.MkdirAll(filepath.Join(src, "sub"), 0755); err != nil {
+		f.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "sub", "file"), []byte("contents"), 0640); err != nil {
+		f.Fatal(err)
+	}
+
+	filter, err := newPathFilter(File{Name: "entry"})
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	data, err := tarFileOrFolder("entry", src, filter)
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	f.Add(data)
+	f.Add(craftTarball(f, craftedMember{name: "entry/../../escaped", typeflag: tar.TypeReg, contents: "x"}))
+	f.Add(craftTarball(f, craftedMember{name: "entry//tmp/escaped", typeflag: tar.TypeReg, contents: "x"}))
+	f.Add(craftTarball(f, craftedMember{name: "/entry/escaped", typeflag: tar.TypeReg, contents: "x"}))
+	f.Add(craftTarball(f, craftedMember{name: "other/entry/file", typeflag: tar.TypeReg, contents: "x"}))
+	f.Add(craftTarball(f, craftedMember{name: "entryfile", typeflag: tar.TypeReg, contents: "x"}))
+	f.Add(craftTarball(f,
+		craftedMember{name: "entry/link", typeflag: tar.TypeSymlink, linkname: "/tmp"},
+		craftedMember{name: "entry/link/escaped", typeflag: tar.TypeReg, contents: "x"},
+	))
+	f.Add(craftTarball(f, craftedMember{name: "entry/hard", typeflag: tar.TypeLink, linkname: "/etc/passwd"}))
+	f.Add([]byte("not a tarball"))
+}
+
+func FuzzMemberPath(f *testing.F) {
+	f.Add("entry", "entry")
+	f.Add("entry", "entry/sub/file")
+	f.Add("entry", "entry/../escaped")
+	f.Add("entry", "entry//etc/passwd")
+	f.Add("entry", "entryfile")
+	f.Add("entry", "other/entry")
+	f.Add("entry", "entry/sub/../../escaped")
+
+	f.Fuzz(func(t *testing.T, name string, member string) {
+		rel, err := memberPath(name, member)
+		if err != nil {
+			if !errors.Is(err, ErrCorruptArchive) {
+				t.Fatalf("memberPath(%q, %q): unexpected error %v", name, member, err)
+			}
+			return
+		}
+
+		root := filepath.FromSlash("/restore/root")
+		if dst := filepath.Join(root, filepath.FromSlash(rel)); !within(dst, root) {
+			t.Fatalf("memberPath(%q, %q) = %q, which escapes the destination", name, member, rel)
+		}
+	})
+}
+
+func FuzzUnpackInto(f *testing.F) {
+	addTarballSeeds(f)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		root := t.TempDir()
+		dst := filepath.Join(root, "dst")
+
+		filter, err := newPathFilter(File{Name: "entry"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tarball := Tarball{}
+		tarball.Buffer.Write(data)
+		_ = tarball.unpackInto("entry", dst, filter)
+
+		err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if path != root && !within(path, dst) {
+				t.Errorf("%s was written outside of the destination", path)
+			}
+
+			if d.Type()&fs.ModeSymlink != 0 {
+				t.Errorf("%s is a symlink", path)
+			}
+
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func FuzzTarredFiles(f *testing.F) {
+	addTarballSeeds(f)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		files, err := tarredFiles("entry", data)
+		if err != nil {
+			return
+		}
+
+		for rel := range files {
+			if rel != "" && !filepath.IsLocal(filepath.FromSlash(rel)) {
+				t.Fatalf("tarredFiles returned the unsafe path %q", rel)
+			}
+		}
+	})
+}
@@ -1,7 +1,6 @@
 package dbkp
 
 import (
-	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
@@ -13,9 +12,9 @@ import (
 	"io"
 	"io/fs"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"syscall"
+	"time"
 
 	"golang.org/x/crypto/pbkdf2"
 	"golang.org/x/term"
@@ -24,89 +23,162 @@ import (
 // A function to be called informing that another file/folder is about to be
 // backed up/restore.
 type ProgressReport struct {
-	Count uint64
-	Total uint64
-	Name  string
+	Count   uint64
+	Total   uint64
+	Name    string
+	Skipped *SkippedFile    // If non-nil, a file of the current entry was skipped. Count, Total and Name are repeated.
+	Secret  *SecretFinding  // If non-nil, a possible secret was found in the current entry. Count, Total and Name are repeated.
+	Failure *CommandFailure // If non-nil, the current Command failed but its OnFailure policy let the run go on. Count, Total and Name are repeated.
+	Message string          // If non-empty, informs about the outcome of the current entry, e.g.: "already up to date". Count, Total and Name are repeated.
+
+	Phase      string // What is being done: PhaseScanning, PhaseCopying, PhaseEncrypting, PhaseDecrypting or PhaseRunning.
+	File       string // The file just copied, relative to the entry's Path, if Phase is PhaseCopying.
+	BytesDone  uint64 // The bytes of all File entries copied so far.
+	BytesTotal uint64 // The bytes of all File entries to be copied, or 0 if unknown.
+
+	Finished bool           // If set, the entry Name finished, successfully unless Error is set. Count is the number of finished entries.
+	Error    error          // For Finished reports, why the entry failed.
+	Duration time.Duration  // For Finished reports, how long the entry took.
+	Command  *CommandResult // If non-nil, a script of the current Command finished. Count, Total and Name are repeated.
+}
+
+// Reports a command failure of the entry name, which is step count of total, to
+// pr.
+func reportFailure(pr chan<- ProgressReport, count uint64, total uint64, failure *CommandFailure) {
+	if pr != nil {
+		pr <- ProgressReport{Count: count, Total: total, Name: failure.Entry, Failure: failure}
+	}
+}
+
+// Reports the result of a script of the entry name, which is step count of
+// total, to pr.
+func reportResult(pr chan<- ProgressReport, count uint64, total uint64, result *CommandResult) {
+	if pr != nil {
+		pr <- ProgressReport{Count: count, Total: total, Name: result.Entry, Command: result}
+	}
+}
+
+// Returns a function that sends reports to pr, or nil if pr is nil.
+func sendTo(pr chan<- ProgressReport) func(ProgressReport) {
+	if pr == nil {
+		return nil
+	}
+	return func(report ProgressReport) {
+		pr <- report
+	}
+}
+
+// Returns a function that reports skipped files of the entry name, which is
+// step count of total, to pr.
+func skipReporter(pr chan<- ProgressReport, count uint64, total uint64, name string) func(SkippedFile) {
+	return func(skipped SkippedFile) {
+		if pr != nil {
+			pr <- ProgressReport{Count: count, Total: total, Name: name, Skipped: &skipped}
+		}
+	}
 }
 
 //go:embed version
 var Version string
 
 // This function copies all files/folders from src into dst. It is the
-// equivalent of "cp -r" except that the restrictions in file are respected.
-func copyFileOrFolder(src string, dst string, file File) error {
+// equivalent of "cp -r" except that the restrictions in filter are respected.
+func copyFileOrFolder(src string, dst string, filter pathFilter) error {
 	fileinfo, err := os.Lstat(src)
 	if err != nil {
 		return err
 	}
 
-	filter, err := newPathFilter(file)
-	if err != nil {
-		return err
-	}
-
-	if fileinfo.IsDir() {
-		return copyDirWithFilter(src, dst, "", filter)
-	} else if fileinfo.Mode().IsRegular() {
-		return copyFile(src, dst)
-	} else if fileinfo.Mode()&os.ModeSymlink == os.ModeSymlink {
+	if fileinfo.Mode()&os.ModeSymlink == os.ModeSymlink {
 		realpath, err := filepath.EvalSymlinks(src)
 		if err != nil {
+			filter.skipped("", "broken symlink")
 			return nil
 		}
 
 		fileinfo, err = os.Stat(realpath)
 		if err != nil {
+			filter.skipped("", "broken symlink")
 			return nil
 		}
 
-		if fileinfo.IsDir() {
-			return copyDirWithFilter(realpath, dst, "", filter)
-		} else if fileinfo.Mode().IsRegular() {
-			return copyFile(realpath, dst)
+		src = realpath
+	}
+
+	if fileinfo.IsDir() {
+		return copyDirWithFilter(src, dst, "", filter)
+	} else if fileinfo.Mode().IsRegular() {
+		if skip, err := filter.skipsFile(src, "", fileinfo); err != nil || skip {
+			return err
 		}
+
+		if skip, err := filter.resolveConflict(dst, "", func() ([]byte, error) { return hashFile(src) }); err != nil || skip {
+			return err
+		}
+
+		sum, err := copyFile(src, dst)
+		if err != nil {
+			return err
+		}
+
+		filter.copied("", fileinfo, sum)
+		return nil
 	}
 
+	filter.skipped("", specialFileReason(fileinfo.Mode()))
 	return nil
 }
 
-// Copy a file from src to dst. If the OS supports hardlinks, use that instead
-// to speedup things.
-func copyFile(src string, dst string) error {
+// Returns the SHA-256 sum of the contents of the file in path.
+func hashFile(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return nil, err
+	}
+
+	return hash.Sum(nil), nil
+}
+
+// Copies the file src to dst, keeping its permissions, and returns the SHA-256
+// sum of its contents.
+func copyFile(src string, dst string) ([]byte, error) {
 	in, err := os.Open(src)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer in.Close()
 
 	out, err := os.Create(dst)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer func() {
-		if e := out.Close(); e != nil {
-			err = e
-		}
-	}()
+	defer out.Close()
 
-	if _, err := io.Copy(out, in); err != nil {
-		return err
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(out, hash), in); err != nil {
+		return nil, err
 	}
 
 	if err := out.Sync(); err != nil {
-		return err
+		return nil, err
 	}
 
 	si, err := os.Stat(src)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if err := os.Chmod(dst, si.Mode()); err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	return hash.Sum(nil), out.Close()
 }
 
 // copyDirWithFilter copies src into dst respecting the provided filter. prefix tracks
@@ -118,6 +190,10 @@ func copyDirWithFilter(src string, dst string, prefix string, filter pathFilter)
 			return err
 		}
 
+		if err := filter.cancelled(); err != nil {
+			return err
+		}
+
 		srcpath := filepath.Join(src, p)
 		dstpath := filepath.Join(dst, p)
 
@@ -127,10 +203,16 @@ func copyDirWithFilter(src string, dst string, prefix string, filter pathFilter)
 		}
 
 		if p == "." {
-			if fileinfo.IsDir() {
-				return os.MkdirAll(dstpath, os.ModeDir|os.ModePerm)
+			if !fileinfo.IsDir() {
+				return nil
 			}
-			return nil
+			if err := filter.loadIgnoreFile(srcpath, prefix); err != nil {
+				return err
+			}
+			if filter.walkOnly(prefix) {
+				return nil
+			}
+			return os.MkdirAll(dstpath, os.ModeDir|os.ModePerm)
 		}
 
 		rel := p
@@ -147,36 +229,61 @@ func copyDirWithFilter(src string, dst string, prefix string, filter pathFilter)
 		}
 
 		if fileinfo.IsDir() {
-			if err := os.MkdirAll(dstpath, os.ModeDir|os.ModePerm); err != nil {
+			if err := filter.loadIgnoreFile(srcpath, rel); err != nil {
 				return err
 			}
-			return nil
-		} else if fileinfo.Mode().IsRegular() {
-			if err := copyFile(srcpath, dstpath); err != nil {
+			if filter.walkOnly(rel) {
+				return nil
+			}
+			if err := os.MkdirAll(dstpath, os.ModeDir|os.ModePerm); err != nil {
 				return err
 			}
-		} else if fileinfo.Mode()&os.ModeSymlink == os.ModeSymlink {
+			return nil
+		}
+
+		if fileinfo.Mode()&os.ModeSymlink == os.ModeSymlink {
 			realpath, err := filepath.EvalSymlinks(srcpath)
 			if err != nil {
+				filter.skipped(rel, "broken symlink")
 				return nil
 			}
 
-			fileinfo, err := os.Stat(realpath)
+			fileinfo, err = os.Stat(realpath)
 			if err != nil {
+				filter.skipped(rel, "broken symlink")
 				return nil
 			}
 
 			if fileinfo.IsDir() {
-				if err := copyDirWithFilter(realpath, dstpath, rel, filter); err != nil {
-					return err
-				}
-			} else if fileinfo.Mode().IsRegular() {
-				if err := copyFile(realpath, dstpath); err != nil {
-					return err
-				}
+				return copyDirWithFilter(realpath, dstpath, rel, filter)
 			}
+
+			srcpath = realpath
 		}
 
+		if !fileinfo.Mode().IsRegular() {
+			filter.skipped(rel, specialFileReason(fileinfo.Mode()))
+			return nil
+		}
+
+		if skip, err := filter.skipsFile(srcpath, rel, fileinfo); err != nil || skip {
+			return err
+		}
+
+		if err := os.MkdirAll(filepath.Dir(dstpath), os.ModeDir|os.ModePerm); err != nil {
+			return err
+		}
+
+		if skip, err := filter.resolveConflict(dstpath, rel, func() ([]byte, error) { return hashFile(srcpath) }); err != nil || skip {
+			return err
+		}
+
+		sum, err := copyFile(srcpath, dstpath)
+		if err != nil {
+			return err
+		}
+
+		filter.copied(rel, fileinfo, sum)
 		return nil
 	})
 }
@@ -202,34 +309,10 @@ func readFile(path string) ([]byte, error) {
 	return buffer, nil
 }
 
-// Executes a commnad inside a shell found shellPath (expected to be sh or to
-// support the -c argument as sh does).
-func executeCommandInShell(shellPath string, command string, stdin *bytes.Buffer, stdout *bytes.Buffer, stderr *bytes.Buffer) error {
-	cmd := exec.Command(shellPath, "-c", command)
-
-	if stdin != nil {
-		cmd.Stdin = stdin
-	}
-
-	if stdout != nil {
-		cmd.Stdout = stdout
-	}
-
-	if stderr != nil {
-		cmd.Stderr = stderr
-	}
-
-	if err := cmd.Run(); err != nil {
-		return err
-	}
-
-	return nil
-}
-
 // Asks for a password in the terminal, unix style.
 func AskForPassword() ([]byte, error) {
-	fmt.Print("Password: ")
-	defer fmt.Println("")
+	fmt.Fprint(os.Stderr, "Password: ")
+	defer fmt.Fprintln(os.Stderr, "")
 	return term.ReadPassword(int(syscall.Stdin))
 }
 
@@ -268,13 +351,13 @@ func Encrypt(key []byte, data []byte) ([]byte, string, error) {
 }
 
 // Decrypts the ciphertext using the given key and salt (IV). Returns the raw
-// data.
+// data, or ErrWrongPassword if key does not decrypt ciphertext.
 func Decrypt(key []byte, salt string, ciphertext []byte) ([]byte, error) {
 	saltbytes, err := hex.DecodeString(salt)
 	if err != nil {
-		return nil, err
+		return nil, corruptArchive(err)
 	} else if len(saltbytes) != 12 {
-		return nil, errors.New("cannot decrypt: salt has wrong size")
+		return nil, corruptArchive(errors.New("salt has wrong size"))
 	}
 
 	b, err := aes.NewCipher(key)
@@ -287,5 +370,10 @@ func Decrypt(key []byte, salt string, ciphertext []byte) ([]byte, error) {
 		return nil, err
 	}
 
-	return aesgcm.Open(nil, saltbytes, ciphertext, nil)
+	data, err := aesgcm.Open(nil, saltbytes, ciphertext, nil)
+	if err != nil {
+		return nil, ErrWrongPassword
+	}
+
+	return data, nil
 }
@@ -0,0 +1,176 @@
+package dbkp
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// A problem found in a recipe.
+type RecipeProblem struct {
+	File   string // The recipe file with the problem, which may be one included by the checked recipe. Set by CheckRecipe.
+	Entry  string // The Name of the entry, empty for the recipe as a whole.
+	Key    string // The key the problem is about, e.g.: "Exclude". Empty for the entry as a whole.
+	Line   int    // The line of Key (or of the entry) in the recipe file, starting at 1. 0 if unknown.
+	Column int    // The column of Key (or of the entry), starting at 1. 0 if unknown.
+	Err    error  // What is wrong.
+}
+
+// Returns the error of the first problem, or nil if there is none.
+func firstProblem(problems []RecipeProblem) error {
+	if len(problems) == 0 {
+		return nil
+	}
+	return problems[0].Err
+}
+
+// Checks that name can be the Name of an entry, which is also a file name
+// inside the backup folder next to the manifest.
+func validateName(name string) error {
+	if name == "" {
+		return errors.New("the Name is empty")
+	} else if name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("the Name %q is not a valid file name", name)
+	} else if name == manifestName {
+		return fmt.Errorf("the Name %q is reserved for the manifest", name)
+	}
+	return nil
+}
+
+// Checks that file can be backed up: its Name is a valid file name, its Path
+// exists and its patterns and rules parse.
+func (file File) Validate() error {
+	return firstProblem(file.problems())
+}
+
+// Returns what Validate checks, as problems with the key they are about.
+func (file File) problems() []RecipeProblem {
+	problems := []RecipeProblem{}
+	add := func(key string, err error) {
+		problems = append(problems, RecipeProblem{Entry: file.Name, Key: key, Err: err})
+	}
+
+	if err := validateName(file.Name); err != nil {
+		add("Name", err)
+	}
+
+	if file.Path == "" {
+		add("Path", errors.New("the Path is empty"))
+	} else if path, err := expandHome(file.Path); err != nil {
+		add("Path", err)
+	} else if _, err := os.Stat(path); err != nil {
+		add("Path", err)
+	}
+
+	if len(file.Only) > 0 && len(file.Exclude) > 0 {
+		add("Exclude", errors.New("Only and Exclude are mutually exclusive"))
+	}
+
+	if _, err := newPathFilter(File{Only: file.Only}); err != nil {
+		add("Only", err)
+	}
+
+	if _, err := newPathFilter(File{Exclude: file.Exclude, ExcludeSyntax: file.ExcludeSyntax}); err != nil {
+		add("Exclude", err)
+	}
+
+	if _, err := newFileLimits(file.SkipRules); err != nil {
+		add("", err)
+	}
+
+	if _, err := newSecretScanner(file.Name, file.AllowSecrets); err != nil {
+		add("AllowSecrets", err)
+	}
+
+	for _, symlink := range file.Symlinks {
+		if symlink[0] == "" || symlink[1] == "" {
+			add("Symlinks", fmt.Errorf("invalid symlink %q -> %q, both sides are required", symlink[0], symlink[1]))
+		}
+	}
+
+	return problems
+}
+
+// Checks that command can be run: its Name is a valid file name, Backup and
+// Restore are set and its settings parse.
+func (command Command) Validate() error {
+	return firstProblem(command.problems())
+}
+
+// Returns what Validate checks, as problems with the key they are about.
+func (command Command) problems() []RecipeProblem {
+	problems := []RecipeProblem{}
+	add := func(key string, err error) {
+		problems = append(problems, RecipeProblem{Entry: command.Name, Key: key, Err: err})
+	}
+
+	if err := validateName(command.Name); err != nil {
+		add("Name", err)
+	}
+
+	switch command.OnFailure {
+	case "", OnFailureAbort, OnFailureWarn, OnFailureSkip:
+	default:
+		add("OnFailure", fmt.Errorf("unknown OnFailure %q", command.OnFailure))
+	}
+
+	timeouts := []struct{ key, value string }{
+		{"Timeout", command.Timeout},
+		{"BackupTimeout", command.BackupTimeout},
+		{"RestoreTimeout", command.RestoreTimeout},
+	}
+	for _, timeout := range timeouts {
+		if _, err := time.ParseDuration(timeout.value); timeout.value != "" && err != nil {
+			add(timeout.key, fmt.Errorf("invalid timeout %q: %w", timeout.value, err))
+		}
+	}
+
+	scripts := []struct{ key, value string }{
+		{"Backup", command.Backup},
+		{"Restore", command.Restore},
+		{"Check", command.Check},
+	}
+	for _, script := range scripts {
+		if script.value == "" && script.key != "Check" {
+			add(script.key, fmt.Errorf("%s is required", script.key))
+		} else if _, err := command.argv(script.value); script.value != "" && err != nil {
+			add(script.key, err)
+		}
+	}
+
+	if _, err := newSecretScanner(command.Name, command.AllowSecrets); err != nil {
+		add("AllowSecrets", err)
+	}
+
+	return problems
+}
+
+// Checks that set can be run: its Name is a valid file name and the scripts
+// it needs are set.
+func (set PackageSet) Validate() error {
+	return firstProblem(set.problems())
+}
+
+// Returns what Validate checks, as problems with the key they are about.
+func (set PackageSet) problems() []RecipeProblem {
+	problems := []RecipeProblem{}
+	add := func(key string, err error) {
+		problems = append(problems, RecipeProblem{Entry: set.Name, Key: key, Err: err})
+	}
+
+	if err := validateName(set.Name); err != nil {
+		add("Name", err)
+	}
+
+	if err := set.validate(); err != nil {
+		add("", err)
+	}
+
+	if _, err := time.ParseDuration(set.Timeout); set.Timeout != "" && err != nil {
+		add("Timeout", fmt.Errorf("invalid timeout %q: %w", set.Timeout, err))
+	}
+
+	return problems
+}
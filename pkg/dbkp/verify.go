@@ -0,0 +1,452 @@
+package dbkp
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// Values of VerifyProblem.Problem.
+const (
+	ProblemMissing     = "missing"     // The manifest lists it, but it is not in the backup.
+	ProblemExtra       = "extra"       // It is in the backup, but the manifest does not list it.
+	ProblemCorrupted   = "corrupted"   // Its size or SHA-256 sum differs from the manifest.
+	ProblemPermissions = "permissions" // It was restored with other permissions than the original file.
+)
+
+// A difference between a backup and its manifest.
+type VerifyProblem struct {
+	Entry    string // The Name of the entry, or the name found in the backup for extra entries.
+	Path     string // The file, relative to the Path of the entry. Empty for the entry itself.
+	Problem  string // ProblemMissing, ProblemExtra, ProblemCorrupted or ProblemPermissions.
+	Restored bool   // Whether it was found in the test restore of VerifyRestore.
+}
+
+// A file read back from a backup.
+type storedFile struct {
+	size int64
+	sum  string
+	mode string // The permissions in octal, if known.
+}
+
+func newStoredFile(data []byte) storedFile {
+	sum := sha256.Sum256(data)
+	return storedFile{size: int64(len(data)), sum: hex.EncodeToString(sum[:])}
+}
+
+// Reads the entries of a plain or encrypted backup.
+type backupContents struct {
+	folder   string   // The dbkp folder of a plain backup.
+	tar      *Tarball // The decrypted tarball of an encrypted backup.
+	password []byte   // Decrypts the Encrypt entries of plain backups.
+}
+
+// Returns the names at the top of the backup.
+func (contents backupContents) names() ([]string, error) {
+	names := []string{}
+
+	if contents.tar != nil {
+		tr := tar.NewReader(bytes.NewReader(contents.tar.Buffer.Bytes()))
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return names, nil
+			} else if err != nil {
+				return nil, corruptArchive(err)
+			}
+			names = append(names, hdr.Name)
+		}
+	}
+
+	entries, err := os.ReadDir(contents.folder)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+
+	return names, nil
+}
+
+// Reads the member name, decrypting it if encrypted is set.
+func (contents backupContents) read(name string, encrypted bool) ([]byte, error) {
+	if contents.tar != nil {
+		data, err := contents.tar.readFile(name)
+		return data.Bytes(), err
+	}
+
+	data, err := os.ReadFile(filepath.Join(contents.folder, name))
+	if err != nil || !encrypted {
+		return data, err
+	}
+
+	return decryptBlob(contents.password, data)
+}
+
+// Returns the files stored for the File entry name, by their path relative to
+// the Path of the entry.
+func (contents backupContents) files(name string, encrypted bool) (map[string]storedFile, error) {
+	if contents.tar != nil || encrypted {
+		data, err := contents.read(name, encrypted)
+		if err != nil {
+			return nil, err
+		}
+		return tarredFiles(name, data)
+	}
+
+	root := filepath.Join(contents.folder, name)
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		data, err := os.ReadFile(root)
+		if err != nil {
+			return nil, err
+		}
+
+		stored := newStoredFile(data)
+		stored.mode = fmt.Sprintf("%04o", info.Mode().Perm())
+		return map[string]storedFile{"": stored}, nil
+	}
+
+	files := map[string]storedFile{}
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		stored := newStoredFile(data)
+		stored.mode = fmt.Sprintf("%04o", info.Mode().Perm())
+		files[filepath.ToSlash(rel)] = stored
+		return nil
+	})
+
+	return files, err
+}
+
+// Returns the files in data, a tarball made by tarFileOrFolder for the entry
+// name, by their path relative to the Path of the entry.
+func tarredFiles(name string, data []byte) (map[string]storedFile, error) {
+	files := map[string]storedFile{}
+	tr := tar.NewReader(bytes.NewReader(data))
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		} else if err != nil {
+			return nil, corruptArchive(err)
+		}
+
+		rel, err := memberPath(name, hdr.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		contents, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, corruptArchive(err)
+		}
+
+		files[rel] = newStoredFile(contents)
+	}
+}
+
+// Checks the backups of recipe, in the folder of the recipe, path, or in the
+// Destinations of the recipe and its entries, against their manifests,
+// reading each file they list. If names is non-empty, only those entries are
+// checked, and extra entries are not reported. Returns the manifests, merged
+// into one, and the differences found.
+func Verify(path string, recipe Recipe, password []byte, names []string) (Manifest, []VerifyProblem, error) {
+	selected, err := filterRecipeByNames(recipe, names)
+	if err != nil {
+		return Manifest{}, nil, err
+	}
+
+	groups, err := destinationGroups(path, recipe, selected)
+	if err != nil {
+		return Manifest{}, nil, err
+	}
+
+	merged := Manifest{}
+	problems := []VerifyProblem{}
+	first := true
+	for i, group := range groups {
+		if len(group.names) == 0 && (i > 0 || len(names) > 0) {
+			continue
+		}
+
+		if err := group.check(); err != nil {
+			return merged, nil, err
+		}
+
+		groupNames := group.names
+		if len(names) == 0 {
+			groupNames = nil
+		}
+
+		manifest, found, err := verifyAt(group.path, recipe, password, groupNames)
+		if err != nil {
+			return manifest, nil, err
+		}
+
+		if first {
+			merged = manifest
+			first = false
+		} else {
+			merged.Entries = append(merged.Entries, manifest.Entries...)
+		}
+		problems = append(problems, found...)
+	}
+
+	return merged, problems, nil
+}
+
+// Checks the backup in path/dbkp against its manifest, like Verify.
+func verifyAt(path string, recipe Recipe, password []byte, names []string) (Manifest, []VerifyProblem, error) {
+	backupPath, err := filepath.Abs(filepath.Join(path, "dbkp"))
+	if err != nil {
+		return Manifest{}, nil, err
+	}
+
+	contents := backupContents{folder: backupPath, password: password}
+	if password != nil && recipe.Encrypted() {
+		tar, err := loadTarball(backupPath, password, recipe)
+		if err != nil {
+			return Manifest{}, nil, err
+		}
+		contents.tar = &tar
+	}
+
+	data, err := contents.read(manifestName, false)
+	if errors.Is(err, fs.ErrNotExist) {
+		return Manifest{}, nil, fmt.Errorf("the backup has no manifest: %w", err)
+	} else if err != nil {
+		return Manifest{}, nil, err
+	}
+
+	manifest, err := parseManifest(data)
+	if err != nil {
+		return manifest, nil, err
+	}
+
+	problems := []VerifyProblem{}
+	for _, entry := range manifest.Entries {
+		if len(names) > 0 && !slices.Contains(names, entry.Name) {
+			continue
+		}
+
+		found, err := verifyEntry(contents, entry)
+		if err != nil {
+			return manifest, nil, &EntryError{Entry: entry.Name, Err: err}
+		}
+		problems = append(problems, found...)
+	}
+
+	if len(names) > 0 {
+		return manifest, problems, nil
+	}
+
+	stored, err := contents.names()
+	if err != nil {
+		return manifest, nil, err
+	}
+
+	known := map[string]struct{}{manifestName: {}}
+	for _, entry := range manifest.Entries {
+		known[entry.Name] = struct{}{}
+		if entry.Stderr != nil {
+			known[entry.Name+stderrSuffix] = struct{}{}
+		}
+	}
+
+	for _, name := range stored {
+		if _, ok := known[name]; !ok {
+			problems = append(problems, VerifyProblem{Entry: name, Problem: ProblemExtra})
+		}
+	}
+
+	return manifest, problems, nil
+}
+
+// Checks the data stored for entry.
+func verifyEntry(contents backupContents, entry ManifestEntry) ([]VerifyProblem, error) {
+	if entry.Kind != "file" {
+		problems, err := verifyOutput(contents, entry.Name, entry.Output, entry.Encrypted)
+		if err != nil || entry.Stderr == nil {
+			return problems, err
+		}
+
+		stderr, err := verifyOutput(contents, entry.Name+stderrSuffix, entry.Stderr, entry.Encrypted)
+		return append(problems, stderr...), err
+	}
+
+	files, err := contents.files(entry.Name, entry.Encrypted)
+	if errors.Is(err, fs.ErrNotExist) && len(entry.Files) == 0 {
+		return nil, nil
+	} else if errors.Is(err, fs.ErrNotExist) {
+		return []VerifyProblem{{Entry: entry.Name, Problem: ProblemMissing}}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return compareFiles(entry, files, false), nil
+}
+
+// Compares files with the ones the manifest lists for entry. The permissions
+// are only compared if checkMode is set.
+func compareFiles(entry ManifestEntry, files map[string]storedFile, checkMode bool) []VerifyProblem {
+	problems := []VerifyProblem{}
+	listed := map[string]struct{}{}
+	for _, file := range entry.Files {
+		listed[file.Path] = struct{}{}
+
+		stored, ok := files[file.Path]
+		if !ok {
+			problems = append(problems, VerifyProblem{Entry: entry.Name, Path: file.Path, Problem: ProblemMissing})
+		} else if stored.size != file.Size || stored.sum != file.SHA256 {
+			problems = append(problems, VerifyProblem{Entry: entry.Name, Path: file.Path, Problem: ProblemCorrupted})
+		} else if checkMode && file.Mode != "" && stored.mode != file.Mode {
+			problems = append(problems, VerifyProblem{Entry: entry.Name, Path: file.Path, Problem: ProblemPermissions})
+		}
+	}
+
+	for _, path := range slices.Sorted(maps.Keys(files)) {
+		if _, ok := listed[path]; !ok {
+			problems = append(problems, VerifyProblem{Entry: entry.Name, Path: path, Problem: ProblemExtra})
+		}
+	}
+
+	return problems
+}
+
+// Checks the output of a Command or PackageSet stored as name.
+func verifyOutput(contents backupContents, name string, record *ManifestFile, encrypted bool) ([]VerifyProblem, error) {
+	if record == nil {
+		return nil, nil
+	}
+
+	data, err := contents.read(name, encrypted)
+	if errors.Is(err, fs.ErrNotExist) {
+		return []VerifyProblem{{Entry: name, Problem: ProblemMissing}}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	stored := newStoredFile(data)
+	if stored.size != record.Size || stored.sum != record.SHA256 {
+		return []VerifyProblem{{Entry: name, Problem: ProblemCorrupted}}, nil
+	}
+
+	return nil, nil
+}
+
+// Restores the File entries and Commands listed in manifest (only the ones in
+// names, if it is not empty) into a temporary directory, with the same code
+// as Restore, and compares the result with the manifest. Command restores are
+// replaced by a stub capturing what they would be fed. PackageSets are not
+// restored.
+func VerifyRestore(ctx context.Context, path string, recipe Recipe, password []byte, manifest Manifest, names []string) ([]VerifyProblem, error) {
+	selected, err := filterRecipeByNames(recipe, names)
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := os.MkdirTemp("", "dbkp-verify-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(root)
+
+	test := selected
+	test.Files = nil
+	test.Commands = nil
+	test.Packages = nil
+
+	for _, file := range selected.Files {
+		if manifest.entry(file.Name) != nil {
+			file.Path = filepath.Join(root, file.Name)
+			test.Files = append(test.Files, file)
+		}
+	}
+
+	for _, command := range selected.Commands {
+		if entry := manifest.entry(command.Name); entry != nil && !entry.Skipped {
+			test.Commands = append(test.Commands, Command{
+				Name:        command.Name,
+				Restore:     "cat > " + shellQuote(filepath.Join(root, command.Name)),
+				Encrypt:     command.Encrypt,
+				Timeout:     command.restoreTimeout(),
+				Destination: command.Destination,
+			})
+		}
+	}
+
+	_, err = Restore(ctx, Options{
+		Path:     path,
+		Recipe:   test,
+		Password: func() ([]byte, error) { return password, nil },
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	restored := backupContents{folder: root}
+	problems := []VerifyProblem{}
+
+	for _, file := range test.Files {
+		entry := manifest.entry(file.Name)
+
+		files, err := restored.files(file.Name, false)
+		if errors.Is(err, fs.ErrNotExist) {
+			files = map[string]storedFile{}
+		} else if err != nil {
+			return nil, err
+		}
+
+		problems = append(problems, compareFiles(*entry, files, true)...)
+	}
+
+	for _, command := range test.Commands {
+		found, err := verifyOutput(restored, command.Name, manifest.entry(command.Name).Output, false)
+		if err != nil {
+			return nil, err
+		}
+		problems = append(problems, found...)
+	}
+
+	for i := range problems {
+		problems[i].Restored = true
+	}
+
+	return problems, nil
+}